@@ -5,4 +5,14 @@ ISUCON_DB_USER="isucon"
 ISUCON_DB_PASSWORD="isucon"
 ISUCON_DB_NAME="isuride"
 # マッチング間隔（秒）
-ISUCON_MATCHING_INTERVAL=0.5
\ No newline at end of file
+ISUCON_MATCHING_INTERVAL=0.5
+# マッチング戦略 (greedy: スコア順の貪欲法, hungarian: 配車までの所要時間の合計を最小化)
+ISUCON_MATCHING_STRATEGY=greedy
+# 通知バス (memory: プロセス内のみ, mysql: notifications テーブル経由で他のホストにも届ける)
+ISUCON_NOTIFICATION_BUS=memory
+# サージ料金 (倍率の上限。1ならサージを掛けない, セルの一辺の長さ, 今回の需給を反映する割合)
+ISUCON_SURGE_MAX=1
+ISUCON_SURGE_CELL_SIZE=50
+ISUCON_SURGE_SMOOTHING=0.3
+# 見積もりIDの署名鍵。複数のホストで同じ値にする
+ISUCON_QUOTE_SECRET=isuride-quote-secret
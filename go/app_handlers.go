@@ -1,16 +1,21 @@
 package main
 
 import (
+	"cmp"
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
+	"github.com/isucon/isucon14/webapp/go/matcher"
+	"github.com/isucon/isucon14/webapp/go/pricing"
 	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid/v2"
 )
@@ -68,59 +73,21 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 初回登録キャンペーンのクーポンを付与
-	_, err = tx2.Exec(
-		"INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?)",
-		userID, "CP_NEW2024", 3000,
-	)
-	if err != nil {
+	if _, err := grantCoupon(tx2, userID, campaignSignup, ""); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	// 招待コードを使った登録
 	if req.InvitationCode != nil && *req.InvitationCode != "" {
-		// 招待する側の招待数をチェック
-		var coupons []Coupon
-		err = tx2.Select(&coupons, "SELECT * FROM coupons WHERE code = ? AND user_id = ? FOR UPDATE", "INV_"+*req.InvitationCode, userID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		if len(coupons) >= 3 {
-			writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
-			return
-		}
-
-		// ユーザーチェック
-		var inviter User
-		err = tx.Get(&inviter, "SELECT * FROM users WHERE invitation_code = ?", *req.InvitationCode)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
+		if err := redeemInvitation(tx, tx2, userID, *req.InvitationCode); err != nil {
+			if errors.Is(err, errInvitationUnavailable) {
+				writeError(w, http.StatusBadRequest, err)
 				return
 			}
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-
-		// 招待クーポン付与
-		_, err = tx2.Exec(
-			"INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?)",
-			userID, "INV_"+*req.InvitationCode, 1500,
-		)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		// 招待した人にもRewardを付与
-		_, err = tx2.Exec(
-			"INSERT INTO coupons (user_id, code, discount) VALUES (?, CONCAT(?, '_', FLOOR(UNIX_TIMESTAMP(NOW(3))*1000)), ?)",
-			inviter.ID, "RWD_"+*req.InvitationCode, 1000,
-		)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -144,10 +111,85 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+type appGetInvitationsResponse struct {
+	InvitationCode string `json:"invitation_code"`
+	// あと何人招待できるか
+	Remaining int `json:"remaining"`
+	// 招待で付与されたクーポンの割引額の合計
+	TotalReward int                             `json:"total_reward"`
+	Invitations []appGetInvitationsResponseItem `json:"invitations"`
+}
+
+type appGetInvitationsResponseItem struct {
+	InviteeUsername string `json:"invitee_username"`
+	JoinedAt        int64  `json:"joined_at"`
+	// 付与されなかったら null
+	Reward *appGetInvitationsResponseReward `json:"reward"`
+}
+
+type appGetInvitationsResponseReward struct {
+	CouponCode string `json:"coupon_code"`
+	Discount   int    `json:"discount"`
+	Used       bool   `json:"used"`
+}
+
+// 自分の招待コードで登録したユーザーと、それで付与されたクーポンを登録順に返す
+func appGetInvitations(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+
+	invitations := []struct {
+		Invitation
+		InviteeUsername string `db:"invitee_username"`
+	}{}
+	if err := db.Select(
+		&invitations,
+		`SELECT invitations.*, users.username AS invitee_username FROM invitations JOIN users ON users.id = invitations.invitee_id
+		 WHERE invitations.inviter_id = ? ORDER BY invitations.created_at, invitations.id`,
+		user.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	rewards := []Coupon{}
+	if err := db2.Select(&rewards, `SELECT * FROM coupons WHERE user_id = ? AND campaign_id = ?`, user.ID, campaignInviter); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	rewardByCode := make(map[string]Coupon, len(rewards))
+	for _, c := range rewards {
+		rewardByCode[c.Code] = c
+	}
+
+	res := &appGetInvitationsResponse{
+		InvitationCode: user.InvitationCode,
+		Remaining:      max(invitationLimit-len(invitations), 0),
+		Invitations:    make([]appGetInvitationsResponseItem, 0, len(invitations)),
+	}
+	for _, inv := range invitations {
+		item := appGetInvitationsResponseItem{
+			InviteeUsername: inv.InviteeUsername,
+			JoinedAt:        inv.CreatedAt.UnixMilli(),
+		}
+		if c, ok := rewardByCode[inv.RewardCouponCode.String]; ok {
+			item.Reward = &appGetInvitationsResponseReward{
+				CouponCode: c.Code,
+				Discount:   c.Discount,
+				Used:       c.UsedBy != nil,
+			}
+			res.TotalReward += c.Discount
+		}
+		res.Invitations = append(res.Invitations, item)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
 type appPostPaymentMethodsRequest struct {
 	Token string `json:"token"`
 }
 
+// 決済トークンを追加する。最初に追加したトークンがデフォルトになる
 func appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
 	req := &appPostPaymentMethodsRequest{}
 	if err := bindJSON(r, req); err != nil {
@@ -161,21 +203,226 @@ func appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
 
 	user := r.Context().Value("user").(*User)
 
-	_, err := db.Exec(
-		`INSERT INTO payment_tokens (user_id, token) VALUES (?, ?)`,
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	tokens, err := lockPaymentTokens(tx, user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, t := range tokens {
+		if t.Token == req.Token {
+			// 登録済み
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	if _, err := tx.Exec(
+		`INSERT INTO payment_tokens (user_id, token, is_default) VALUES (?, ?, ?)`,
 		user.ID,
 		req.Token,
-	)
+		len(tokens) == 0,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type appGetPaymentMethodsResponse struct {
+	PaymentMethods []appGetPaymentMethodsResponseItem `json:"payment_methods"`
+}
+
+type appGetPaymentMethodsResponseItem struct {
+	ID int64 `json:"id"`
+	// トークンそのものは返さず、末尾だけ見せる
+	MaskedToken string `json:"masked_token"`
+	IsDefault   bool   `json:"is_default"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+// 決済トークンを評価時に使う順 (デフォルトが先頭) に返す
+func appGetPaymentMethods(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+
+	tokens, err := getPaymentTokens(db, user.ID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	items := make([]appGetPaymentMethodsResponseItem, 0, len(tokens))
+	for _, t := range tokens {
+		items = append(items, appGetPaymentMethodsResponseItem{
+			ID:          t.ID,
+			MaskedToken: maskPaymentToken(t.Token),
+			IsDefault:   t.IsDefault,
+			CreatedAt:   t.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, &appGetPaymentMethodsResponse{PaymentMethods: items})
+}
+
+// 決済トークンを削除する。デフォルトを削除したら、残りのうち最も古いものをデフォルトにする
+func appDeletePaymentMethod(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	id, err := strconv.ParseInt(r.PathValue("payment_method_id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid payment_method_id: %w", err))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	tokens, err := lockPaymentTokens(tx, user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	idx := slices.IndexFunc(tokens, func(t PaymentToken) bool { return t.ID == id })
+	if idx < 0 {
+		writeError(w, http.StatusNotFound, errors.New("payment method not found"))
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM payment_tokens WHERE id = ?`, id); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if tokens[idx].IsDefault {
+		rest := slices.Delete(tokens, idx, idx+1)
+		if len(rest) > 0 {
+			oldest := slices.MinFunc(rest, func(a, b PaymentToken) int { return cmp.Compare(a.ID, b.ID) })
+			if _, err := tx.Exec(`UPDATE payment_tokens SET is_default = 1 WHERE id = ?`, oldest.ID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func appPostPaymentMethodDefault(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	id, err := strconv.ParseInt(r.PathValue("payment_method_id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid payment_method_id: %w", err))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	tokens, err := lockPaymentTokens(tx, user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !slices.ContainsFunc(tokens, func(t PaymentToken) bool { return t.ID == id }) {
+		writeError(w, http.StatusNotFound, errors.New("payment method not found"))
+		return
+	}
+
+	if _, err := tx.Exec(`UPDATE payment_tokens SET is_default = (id = ?) WHERE user_id = ?`, id, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+type appGetCouponsResponse struct {
+	Coupons []appGetCouponsResponseItem `json:"coupons"`
+}
+
+type appGetCouponsResponseItem struct {
+	Code string `json:"code"`
+	// FIXED なら discount は割引額、PERCENT なら割引率 (%) で、max_discount が割引額の上限
+	DiscountType  string `json:"discount_type"`
+	Discount      int    `json:"discount"`
+	MaxDiscount   *int64 `json:"max_discount,omitempty"`
+	ExpiresAt     *int64 `json:"expires_at,omitempty"`
+	FirstRideOnly bool   `json:"first_ride_only"`
+	MinFare       *int64 `json:"min_fare,omitempty"`
+	CreatedAt     int64  `json:"created_at"`
+}
+
+// 使っていないクーポンを、coupon_code を省略したときに選ばれる順に返す。期限切れのものは返さない
+func appGetCoupons(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+
+	coupons, err := listCoupons(db2, user.ID, false)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	now := time.Now()
+	items := make([]appGetCouponsResponseItem, 0, len(coupons))
+	for _, c := range coupons {
+		if c.ExpiresAt.Valid && !now.Before(c.ExpiresAt.Time) {
+			continue
+		}
+		item := appGetCouponsResponseItem{
+			Code:          c.Code,
+			DiscountType:  discountTypeFixed,
+			Discount:      c.Discount,
+			FirstRideOnly: c.FirstRideOnly.Bool,
+			CreatedAt:     c.CreatedAt.UnixMilli(),
+		}
+		if c.DiscountType.Valid {
+			item.DiscountType = c.DiscountType.String
+		}
+		if c.MaxDiscount.Valid {
+			item.MaxDiscount = &c.MaxDiscount.Int64
+		}
+		if c.ExpiresAt.Valid {
+			expiresAt := c.ExpiresAt.Time.UnixMilli()
+			item.ExpiresAt = &expiresAt
+		}
+		if c.MinFare.Valid {
+			item.MinFare = &c.MinFare.Int64
+		}
+		items = append(items, item)
+	}
+
+	writeJSON(w, http.StatusOK, &appGetCouponsResponse{Coupons: items})
+}
+
 type getAppRidesResponse struct {
 	Rides []getAppRidesResponseItem `json:"rides"`
+	// 続きがあれば次のページの cursor に渡す。無ければ空
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 type getAppRidesResponseItem struct {
@@ -184,9 +431,11 @@ type getAppRidesResponseItem struct {
 	DestinationCoordinate Coordinate                   `json:"destination_coordinate"`
 	Chair                 getAppRidesResponseItemChair `json:"chair"`
 	Fare                  int                          `json:"fare"`
+	Status                string                       `json:"status"`
 	Evaluation            int                          `json:"evaluation"`
 	RequestedAt           int64                        `json:"requested_at"`
-	CompletedAt           int64                        `json:"completed_at"`
+	// 終わっていないライドは0
+	CompletedAt int64 `json:"completed_at"`
 }
 
 type getAppRidesResponseItemChair struct {
@@ -196,35 +445,124 @@ type getAppRidesResponseItemChair struct {
 	Model string `json:"model"`
 }
 
+const maxAppGetRidesLimit = 100
+
+// 利用履歴をライドIDの新しい順に返す
+// limit を指定したら next_cursor でページを送る。since, until は要求日時 (ミリ秒) で絞り込む
+// include_unfinished=true なら終わっていないライドも今のステータスと一緒に返す (キャンセルしたライドは返さない)
 func appGetRides(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value("user").(*User)
 
-	tx, err := db.Beginx()
+	query := r.URL.Query()
+	limit := 0
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAppGetRidesLimit {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxAppGetRidesLimit))
+			return
+		}
+		limit = n
+	}
+	since, err := parseUnixMilliQuery(r, "since")
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	defer tx.Rollback()
-	tx2, err := db2.Beginx()
+	until, err := parseUnixMilliQuery(r, "until")
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	defer tx2.Rollback()
+	includeUnfinished := query.Get("include_unfinished") == "true"
 
+	conds := []string{"user_id = ?"}
+	args := []any{user.ID}
+	if includeUnfinished {
+		conds = append(conds, "(evaluation IS NOT NULL OR canceled_at IS NULL)")
+	} else {
+		conds = append(conds, "evaluation IS NOT NULL")
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		conds = append(conds, "id < ?")
+		args = append(args, cursor)
+	}
+	if since != nil {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, *since)
+	}
+	if until != nil {
+		conds = append(conds, "created_at <= ? + INTERVAL 999 MICROSECOND")
+		args = append(args, *until)
+	}
+	q := `SELECT * FROM rides WHERE ` + strings.Join(conds, " AND ") + ` ORDER BY id DESC`
+	if limit > 0 {
+		// 1件多く取って続きがあるか確かめる
+		q += ` LIMIT ?`
+		args = append(args, limit+1)
+	}
 	rides := []Ride{}
-	if err := tx.Select(
-		&rides,
-		`SELECT * FROM rides WHERE user_id = ? AND evaluation IS NOT NULL ORDER BY id DESC`,
-		user.ID,
-	); err != nil {
+	if err := db.Select(&rides, q, args...); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	nextCursor := ""
+	if limit > 0 && len(rides) > limit {
+		rides = rides[:limit]
+		nextCursor = rides[limit-1].ID
+	}
 
-	items := []getAppRidesResponseItem{}
+	// 椅子・オーナー・クーポン・ステータスはページ分まとめて引く
+	rideIDs := make([]string, 0, len(rides))
+	unfinishedRideIDs := []string{}
+	chairIDs := []string{}
 	for _, ride := range rides {
-		fare, err := calculateDiscountedFare(tx2, user.ID, &ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+		rideIDs = append(rideIDs, ride.ID)
+		if ride.Evaluation == nil {
+			unfinishedRideIDs = append(unfinishedRideIDs, ride.ID)
+		}
+		if ride.ChairID.Valid {
+			chairIDs = append(chairIDs, ride.ChairID.String)
+		}
+	}
+	chairs, err := getChairsMinimal(db, chairIDs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	ownerIDs := make([]string, 0, len(chairs))
+	for _, chair := range chairs {
+		ownerIDs = append(ownerIDs, chair.OwnerID)
+	}
+	ownerNames, err := getOwnerNames(db2, ownerIDs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	coupons, err := rideCoupons(db2, rideIDs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	statuses, err := getLatestRideStatuses(db2, unfinishedRideIDs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	items := make([]getAppRidesResponseItem, 0, len(rides))
+	for _, ride := range rides {
+		status := "COMPLETED"
+		if ride.Evaluation == nil {
+			s, ok := statuses[ride.ID]
+			if !ok {
+				// ride_status をコミットできなかったライドは配車されないので返さない
+				// (次の配車のときにキャンセル扱いになる)
+				continue
+			}
+			status = s
+		}
+
+		rule, err := fareRules.version(ride.FareRuleVersion)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
@@ -234,56 +572,110 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 			ID:                    ride.ID,
 			PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
 			DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
-			Fare:                  fare,
-			Evaluation:            *ride.Evaluation,
+			Status:                status,
 			RequestedAt:           ride.CreatedAt.UnixMilli(),
-			CompletedAt:           ride.UpdatedAt.UnixMilli(),
 		}
-
-		item.Chair = getAppRidesResponseItemChair{}
-
-		chair := &Chair{}
-		if v, ok := chairMinimalCache.Load(ride.ChairID); ok {
-			chair = v.(*Chair)
-		} else {
-			if err := tx.Get(chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-			chairMinimalCache.Store(ride.ChairID, chair)
+		if ride.Evaluation != nil {
+			item.Evaluation = *ride.Evaluation
+			item.CompletedAt = ride.UpdatedAt.UnixMilli()
 		}
-		item.Chair.ID = chair.ID
-		item.Chair.Name = chair.Name
-		item.Chair.Model = chair.Model
 
-		owner := &Owner{}
-		if err := db2.Get(owner, `SELECT * FROM owners WHERE id = ?`, chair.OwnerID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+		model := ""
+		if chair, ok := chairs[ride.ChairID.String]; ok {
+			model = chair.Model
+			item.Chair = getAppRidesResponseItemChair{
+				ID:    chair.ID,
+				Owner: ownerNames[chair.OwnerID],
+				Name:  chair.Name,
+				Model: chair.Model,
+			}
 		}
-		item.Chair.Owner = owner.Name
+		item.Fare = rideDiscountedFare(rule, model, &ride, coupons[ride.ID])
 
 		items = append(items, item)
 	}
 
-	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
 	writeJSON(w, http.StatusOK, &getAppRidesResponse{
-		Rides: items,
+		Rides:      items,
+		NextCursor: nextCursor,
 	})
 }
 
+// ミリ秒の UNIX 時刻のクエリパラメータ。省略されていたら nil
+func parseUnixMilliQuery(r *http.Request, name string) (*time.Time, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	t := time.UnixMilli(parsed)
+	return &t, nil
+}
+
+// 椅子を chairMinimalCache から引き、無いものはまとめて DB から引く
+func getChairsMinimal(tx executableSelect, chairIDs []string) (map[string]*Chair, error) {
+	chairs := make(map[string]*Chair, len(chairIDs))
+	missing := []string{}
+	for _, id := range chairIDs {
+		if v, ok := chairMinimalCache.Load(id); ok {
+			chairs[id] = v.(*Chair)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return chairs, nil
+	}
+	query, args, err := sqlx.In(`SELECT * FROM chairs WHERE id IN (?)`, missing)
+	if err != nil {
+		return nil, err
+	}
+	rows := []*Chair{}
+	if err := tx.Select(&rows, query, args...); err != nil {
+		return nil, err
+	}
+	for _, chair := range rows {
+		chairs[chair.ID] = chair
+		chairMinimalCache.Store(chair.ID, chair)
+	}
+	return chairs, nil
+}
+
+func getOwnerNames(tx executableSelect, ownerIDs []string) (map[string]string, error) {
+	names := make(map[string]string, len(ownerIDs))
+	if len(ownerIDs) == 0 {
+		return names, nil
+	}
+	query, args, err := sqlx.In(`SELECT id, name FROM owners WHERE id IN (?)`, ownerIDs)
+	if err != nil {
+		return nil, err
+	}
+	rows := []Owner{}
+	if err := tx.Select(&rows, query, args...); err != nil {
+		return nil, err
+	}
+	for _, owner := range rows {
+		names[owner.ID] = owner.Name
+	}
+	return names, nil
+}
+
 type appPostRidesRequest struct {
 	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	// 見積もりで返した見積もりID。省略したら今の運賃で配車する
+	QuoteID string `json:"quote_id"`
+	// 使うクーポン。省略したら自動で選ぶ
+	CouponCode string `json:"coupon_code"`
 }
 
 type appPostRidesResponse struct {
-	RideID string `json:"ride_id"`
-	Fare   int    `json:"fare"`
+	RideID          string  `json:"ride_id"`
+	Fare            int     `json:"fare"`
+	SurgeMultiplier float64 `json:"surge_multiplier"`
 }
 
 type executableGet interface {
@@ -298,14 +690,6 @@ type rideStatus struct {
 	UpdatedAt time.Time
 }
 
-func getLatestRideStatus(tx executableGet, rideID string) (string, error) {
-	var s string
-	if err := tx.Get(&s, `SELECT status FROM ride_status WHERE ride_id = ?`, rideID); err != nil {
-		return "", err
-	}
-	return s, nil
-}
-
 func appPostRides(w http.ResponseWriter, r *http.Request) {
 	req := &appPostRidesRequest{}
 	if err := bindJSON(r, req); err != nil {
@@ -320,139 +704,317 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value("user").(*User)
 	rideID := ulid.Make().String()
 
-	tx, err := db.Beginx()
-	if err != nil {
+	// 見積もりIDがあれば、見積もったときの運賃で配車する
+	var quote *fareQuote
+	if req.QuoteID != "" {
+		q, err := verifyQuote(req.QuoteID, time.Now())
+		if err != nil {
+			if errors.Is(err, errQuoteExpired) {
+				writeError(w, http.StatusGone, err)
+				return
+			}
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !q.matches(user.ID, *req.PickupCoordinate, *req.DestinationCoordinate) {
+			writeError(w, http.StatusBadRequest, errors.New("quote does not match the ride"))
+			return
+		}
+		if req.CouponCode != "" && req.CouponCode != q.CouponCode {
+			writeError(w, http.StatusBadRequest, errors.New("coupon_code does not match the quote"))
+			return
+		}
+		// 使ったかどうかはライドを記録するときに rides_quote_id_index でも確かめる。ここでは与信を取る前に断る
+		var used bool
+		if err := db.Get(&used, `SELECT EXISTS(SELECT 1 FROM rides WHERE quote_id = ?)`, q.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if used {
+			writeError(w, http.StatusConflict, errQuoteUsed)
+			return
+		}
+		quote = q
+	}
+
+	// 決済ゲートウェイで与信を取るまではロックを取らない。与信はトランザクションの外で取り、記録だけをトランザクションで行う
+	var continuingRideCount int
+	if err := db.Get(&continuingRideCount, `SELECT count(*) FROM rides WHERE user_id = ? AND evaluation IS NULL AND canceled_at IS NULL`, user.ID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	defer tx.Rollback()
-	tx2, err := db2.Beginx()
+	if continuingRideCount > 0 {
+		canceled, err := cancelOrphanRides(user.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		continuingRideCount -= canceled
+	}
+	if continuingRideCount > 0 {
+		writeError(w, http.StatusConflict, errors.New("ride already exists"))
+		return
+	}
+
+	// 決済できないユーザーは配車しない
+	paymentTokens, err := getPaymentTokens(db, user.ID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	defer tx2.Rollback()
+	if len(paymentTokens) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("payment token not registered"))
+		return
+	}
+	if err := checkPaymentGateway(); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
 
-	var continuingRideCount int
-	if err := tx.Get(&continuingRideCount, `SELECT count(*) FROM rides WHERE user_id = ? AND evaluation IS NULL`, user.ID); err != nil {
+	// 見積もったルールとサージを記録しておき、後で変わってもこのライドの運賃は変えない
+	var fareRule *pricing.Rule
+	var surgePercent int
+	if quote != nil {
+		fareRule, err = fareRules.version(quote.FareRuleVersion)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		surgePercent = quote.SurgePercent
+	} else {
+		fareRule, err = fareRules.current()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		surgePercent, err = surge.percent(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	// 椅子が決まる前の割引前の運賃でクーポンを選ぶ。ロックはライドを記録するときに取り直す
+	distance := calculateDistance(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	baseFare := fareRule.Fare(distance, "", surgePercent)
+	priorRides, err := countPriorRides(db, user.ID, rideID)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	if continuingRideCount > 0 {
-		writeError(w, http.StatusConflict, errors.New("ride already exists"))
+	var coupon *campaignCoupon
+	if quote != nil {
+		// 見積もったときのクーポンを使う。他のライドで使われていたり、見積もってから初回でなくなったりしたら見積もりどおりにできない
+		if quote.CouponCode != "" {
+			coupon, err = findCoupon(db2, user.ID, quote.CouponCode, false)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					writeError(w, http.StatusConflict, errQuotedCouponUnavailable)
+					return
+				}
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if !coupon.eligible(time.Now(), priorRides, baseFare) {
+				writeError(w, http.StatusConflict, errQuotedCouponUnavailable)
+				return
+			}
+		}
+	} else {
+		coupon, err = chooseCoupon(db2, user.ID, req.CouponCode, priorRides, baseFare, false)
+		if err != nil {
+			writeCouponError(w, err)
+			return
+		}
+	}
+
+	// 見積もりIDで配車したら、椅子のモデルによらず見積もった運賃を請求する
+	var quotedFare sql.NullInt64
+	var quoteID sql.NullString
+	if quote != nil {
+		quotedFare = sql.NullInt64{Int64: int64(quote.Fare), Valid: true}
+		quoteID = sql.NullString{String: quote.ID, Valid: true}
+	}
+	ride := Ride{
+		ID:                    rideID,
+		UserID:                user.ID,
+		PickupLatitude:        req.PickupCoordinate.Latitude,
+		PickupLongitude:       req.PickupCoordinate.Longitude,
+		DestinationLatitude:   req.DestinationCoordinate.Latitude,
+		DestinationLongitude:  req.DestinationCoordinate.Longitude,
+		PaymentIdempotencyKey: paymentIdempotencyKey(rideID),
+		FareRuleVersion:       fareRule.Version,
+		SurgePercent:          surgePercent,
+		QuotedFare:            quotedFare,
+		QuoteID:               quoteID,
+	}
+	fare := rideDiscountedFare(fareRule, "", &ride, coupon)
+
+	// 見積もった運賃で与信を取っておき、完了したときに確定する
+	// 見積もりIDが無ければ、どのモデルの椅子が割り当てられても確定できる額で与信を取る
+	holdAmount := fare
+	if !ride.QuotedFare.Valid {
+		holdAmount = fareRule.HoldFare(distance, surgePercent, couponDiscount(coupon, baseFare))
+	}
+	hold, err := placePaymentHold(&ride, paymentTokens, holdAmount)
+	if err != nil {
+		var rejected *paymentRejectedError
+		switch {
+		case errors.As(err, &rejected):
+			writeError(w, http.StatusPaymentRequired, errors.New("all payment methods were declined"))
+		case errors.Is(err, erroredUpstream):
+			writeError(w, http.StatusBadGateway, err)
+		default:
+			writeError(w, http.StatusInternalServerError, err)
+		}
 		return
 	}
+	// ライドを記録できなかったら与信を取り消す
+	committed := false
+	defer func() {
+		if !committed {
+			go voidPaymentHold(hold)
+		}
+	}()
 
-	if _, err := tx.Exec(
-		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude)
-				  VALUES (?, ?, ?, ?, ?, ?)`,
-		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude,
-	); err != nil {
+	tx, err := db.Beginx()
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-
-	// rideStatusCache.Store(rideID, rideStatus{rideID, "MATCHING", time.Now()})
-	if _, err := tx2.Exec(`INSERT INTO ride_status (ride_id, status) VALUES (?, 'MATCHING')`, rideID); err != nil {
+	defer tx.Rollback()
+	tx2, err := db2.Beginx()
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	defer tx2.Rollback()
 
-	var rideCount int
-	if err := tx.Get(&rideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ? `, user.ID); err != nil {
+	if _, err := tx.Exec(
+		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, payment_idempotency_key, fare_rule_version, surge_percent, quoted_fare, quote_id)
+				  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		ride.ID, ride.UserID, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude, ride.PaymentIdempotencyKey, ride.FareRuleVersion, ride.SurgePercent, ride.QuotedFare, ride.QuoteID,
+	); err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDupEntry && ride.QuoteID.Valid {
+			// 同じ見積もりで同時に配車された
+			writeError(w, http.StatusConflict, errQuoteUsed)
+			return
+		}
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	var coupon Coupon
-	if rideCount == 1 {
-		// 初回利用で、初回利用クーポンがあれば必ず使う
-		if err := tx2.Get(&coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL FOR UPDATE", user.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-
-			// 無ければ他のクーポンを付与された順番に使う
-			if err := tx2.Get(&coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
-			} else {
-				if _, err := tx2.Exec(
-					"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
-					rideID, user.ID, coupon.Code,
-				); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
+	// rideStatusCache.Store(rideID, rideStatus{rideID, "MATCHING", time.Now()})
+	if _, err := rideStateMachine.Transition(tx2, rideID, "MATCHING", rideActorUser); err != nil {
+		writeRideTransitionError(w, err)
+		return
+	}
+
+	if coupon != nil {
+		// 選んでから使われていないか、ロックして確かめる
+		if _, err := findCoupon(tx2, user.ID, coupon.Code, true); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				if quote != nil {
+					writeError(w, http.StatusConflict, errQuotedCouponUnavailable)
+				} else {
+					writeError(w, http.StatusConflict, errors.New("the coupon was used by another ride, please try again"))
 				}
-			}
-		} else {
-			if _, err := tx2.Exec(
-				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = 'CP_NEW2024'",
-				rideID, user.ID,
-			); err != nil {
-				writeError(w, http.StatusInternalServerError, err)
 				return
 			}
+			writeError(w, http.StatusInternalServerError, err)
+			return
 		}
-	} else {
-		// 他のクーポンを付与された順番に使う
-		if err := tx2.Get(&coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-		} else {
-			if _, err := tx2.Exec(
-				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
-				rideID, user.ID, coupon.Code,
-			); err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
+		if err := useCoupon(tx2, rideID, coupon); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
 		}
 	}
-
-	ride := Ride{
-		ID:                   rideID,
-		UserID:               user.ID,
-		PickupLatitude:       req.PickupCoordinate.Latitude,
-		PickupLongitude:      req.PickupCoordinate.Longitude,
-		DestinationLatitude:  req.DestinationCoordinate.Latitude,
-		DestinationLongitude: req.DestinationCoordinate.Longitude,
-	}
-
-	fare, err := calculateDiscountedFare(tx2, user.ID, &ride, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
-	if err != nil {
+	if err := recordPaymentHold(tx2, hold); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	// rides を先にコミットする。ride_status をコミットできなかったらライドをキャンセル扱いにして、次のライドを作れるようにする
 	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 	if err := tx2.Commit(); err != nil {
+		abandonRide(rideID)
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	committed = true
 
 	writeJSON(w, http.StatusAccepted, &appPostRidesResponse{
-		RideID: rideID,
-		Fare:   fare,
+		RideID:          rideID,
+		Fare:            fare,
+		SurgeMultiplier: surgeMultiplier(surgePercent),
 	})
 }
 
+var errQuotedCouponUnavailable = errors.New("the coupon in the quote is no longer available, please estimate the fare again")
+
+// MySQL の重複キーエラー (ER_DUP_ENTRY)
+const mysqlErrDupEntry = 1062
+
+// ride_status をコミットする前にプロセスが落ちると、ステータスの無いライドが残る
+// 作ってからこれだけ経ってもステータスが無いライドは、作れなかったものとしてキャンセル扱いにする
+const orphanRideGrace = 30 * time.Second
+
+// ステータスの無い古いライドをキャンセル扱いにして、その数を返す
+func cancelOrphanRides(userID string) (int, error) {
+	rideIDs := []string{}
+	if err := db.Select(
+		&rideIDs,
+		`SELECT id FROM rides WHERE user_id = ? AND evaluation IS NULL AND canceled_at IS NULL AND created_at < ?`,
+		userID, time.Now().Add(-orphanRideGrace),
+	); err != nil {
+		return 0, err
+	}
+	statuses, err := getLatestRideStatuses(db2, rideIDs)
+	if err != nil {
+		return 0, err
+	}
+	canceled := 0
+	for _, id := range rideIDs {
+		if _, ok := statuses[id]; ok {
+			continue
+		}
+		if err := abandonRide(id); err != nil {
+			return 0, err
+		}
+		canceled++
+	}
+	return canceled, nil
+}
+
+// ステータスを記録できなかったライドをキャンセル扱いにする。クーポンは使われておらず、与信は PLACING のまま残るのでリコンサイラが取り消す
+func abandonRide(rideID string) error {
+	if _, err := db.Exec(`UPDATE rides SET canceled_at = NOW(6) WHERE id = ? AND canceled_at IS NULL`, rideID); err != nil {
+		slog.Error("failed to abandon ride", "ride_id", rideID, "err", err)
+		return err
+	}
+	slog.Warn("abandoned ride without status", "ride_id", rideID)
+	return nil
+}
+
 type appPostRidesEstimatedFareRequest struct {
 	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	// 使うクーポン。省略したら自動で選ぶ
+	CouponCode string `json:"coupon_code"`
 }
 
 type appPostRidesEstimatedFareResponse struct {
 	Fare     int `json:"fare"`
 	Discount int `json:"discount"`
+	// 配車位置の混み具合で運賃に掛かる倍率。1ならサージなし
+	SurgeMultiplier float64 `json:"surge_multiplier"`
+	// ライドの作成で渡すと、有効期限までこの運賃で配車する
+	QuoteID        string `json:"quote_id"`
+	QuoteExpiresAt int64  `json:"quote_expires_at"`
 }
 
 func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
@@ -475,7 +1037,38 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx2.Rollback()
 
-	discounted, err := calculateDiscountedFare(tx2, user.ID, nil, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	priorRides, err := countPriorRides(db, user.ID, "")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	rule, err := fareRules.current()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	estimate, err := estimateFare(tx2, user.ID, req.CouponCode, priorRides, rule, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	if err != nil {
+		writeCouponError(w, err)
+		return
+	}
+	couponCode := ""
+	if estimate.Coupon != nil {
+		couponCode = estimate.Coupon.Code
+	}
+
+	expiresAt := time.Now().Add(quoteTTL)
+	quoteID, err := signQuote(&fareQuote{
+		ID:              ulid.Make().String(),
+		UserID:          user.ID,
+		Pickup:          *req.PickupCoordinate,
+		Destination:     *req.DestinationCoordinate,
+		FareRuleVersion: rule.Version,
+		SurgePercent:    estimate.Surge,
+		CouponCode:      couponCode,
+		Fare:            estimate.Discounted,
+		ExpiresAt:       expiresAt.UnixMilli(),
+	})
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -487,20 +1080,26 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 	}
 
 	writeJSON(w, http.StatusOK, &appPostRidesEstimatedFareResponse{
-		Fare:     discounted,
-		Discount: calculateFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude) - discounted,
+		Fare:            estimate.Discounted,
+		Discount:        estimate.Fare - estimate.Discounted,
+		SurgeMultiplier: surgeMultiplier(estimate.Surge),
+		QuoteID:         quoteID,
+		QuoteExpiresAt:  expiresAt.UnixMilli(),
 	})
 }
 
+// 指定されたクーポンが使えないなら400、それ以外は500
+func writeCouponError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errCouponNotFound) || errors.Is(err, errCouponNotApplicable) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
+
 // マンハッタン距離を求める
 func calculateDistance(aLatitude, aLongitude, bLatitude, bLongitude int) int {
-	return abs(aLatitude-bLatitude) + abs(aLongitude-bLongitude)
-}
-func abs(a int) int {
-	if a < 0 {
-		return -a
-	}
-	return a
+	return matcher.Distance(aLatitude, aLongitude, bLatitude, bLongitude)
 }
 
 type appPostRideEvaluationRequest struct {
@@ -554,18 +1153,33 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		}
 		rideCache.Store(rideID, ride)
 	}
-	status, err := getLatestRideStatus(tx2, ride.ID)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	if status == "COMPLETED" {
-		writeError(w, http.StatusBadRequest, fmt.Errorf("already completed status=%s ride_id=%s", status, rideID))
+	// ARRIVED 以外からは COMPLETED にできない
+	if _, err := rideStateMachine.Transition(tx2, ride.ID, "COMPLETED", rideActorUser); err != nil {
+		// タイムアウトなどで評価が再送されたときは、課金し直さずに最初の完了日時を返す
+		var te *rideTransitionError
+		if errors.As(err, &te) && te.Current == "COMPLETED" {
+			completedAt, ok, err := previousRideCompletion(tx2, ride.ID)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if ok {
+				writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
+					CompletedAt: completedAt.UnixMilli(),
+				})
+				return
+			}
+		}
+		writeRideTransitionError(w, err)
 		return
 	}
-	if status != "ARRIVED" {
-		writeError(w, http.StatusBadRequest, fmt.Errorf("not arrived yet status=%s ride_id=%s", status, rideID))
+	// 決済ゲートウェイが落ちている間は完了させず、後でやり直してもらう
+	if err := checkPaymentGateway(); err != nil {
+		if errors.Is(err, erroredUpstream) {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -585,12 +1199,6 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// rideStatusCache.Store(rideID, rideStatus{rideID, "COMPLETED", time.Now()})
-	if _, err := tx2.Exec(`UPDATE ride_status SET status = 'COMPLETED' WHERE ride_id = ?`, rideID); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
 	if v, ok := rideCache.Load(rideID); ok {
 		ride = v.(*Ride)
 	} else {
@@ -605,49 +1213,43 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		rideCache.Store(rideID, ride)
 	}
 
-	paymentToken := &PaymentToken{}
-	if err := tx.Get(paymentToken, `SELECT * FROM payment_tokens WHERE user_id = ?`, ride.UserID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusBadRequest, errors.New("payment token not registered"))
-			return
-		}
+	fare, err := calculateDiscountedFare(tx2, ride.UserID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-
-	fare, err := calculateDiscountedFare(tx2, ride.UserID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	// オーナーの売上は記録した売上を集計する。完了日時は変えない
+	sale, err := rideSale(ride)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	paymentGatewayRequest := &paymentGatewayPostPaymentRequest{
-		Amount: fare,
+	if _, err := tx.Exec(`UPDATE rides SET sale = ?, updated_at = updated_at WHERE id = ?`, sale, ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
-
-	var paymentGatewayURL string
-	if u, ok := urlCache.Load("payment_gateway_url"); ok {
-		paymentGatewayURL = u.(string)
-	} else {
-		if err := tx.Get(&paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+	// 作成時に取った与信を確定する。決済はコミット後にワーカーが送る
+	// 運賃が与信額を超えていたら (与信の計算の誤り) 黙って与信額で確定せずにエラーにする
+	captured, err := capturePaymentHold(tx2, ride.ID, fare)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !captured {
+		// 与信の無いライドはデフォルトのトークンで決済し、拒否されたらワーカーが次のトークンで決済し直す
+		paymentTokens, err := getPaymentTokens(tx, ride.UserID)
+		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		urlCache.Store("payment_gateway_url", paymentGatewayURL)
-	}
-
-	if err := requestPaymentGatewayPostPayment(paymentGatewayURL, paymentToken.Token, paymentGatewayRequest, func() ([]Ride, error) {
-		rides := []Ride{}
-		if err := tx.Select(&rides, `SELECT * FROM rides WHERE user_id = ? ORDER BY id ASC`, ride.UserID); err != nil {
-			return nil, err
+		if len(paymentTokens) == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("payment token not registered"))
+			return
 		}
-		return rides, nil
-	}); err != nil {
-		if errors.Is(err, erroredUpstream) {
-			writeError(w, http.StatusBadGateway, err)
+		if err := enqueuePayment(tx2, ride, paymentTokens[0].Token, fare); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		writeError(w, http.StatusInternalServerError, err)
-		return
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -658,18 +1260,95 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	wakePaymentWorkers()
 	chairsInRide.Delete(ride.ChairID.String)
 	slog.Debug("ride completed", "ride_id", rideID)
-	sendNotificationSSE(ride.ChairID.String, ride, "COMPLETED")
-	sendNotificationSSEApp(ride.UserID, ride, "COMPLETED")
+	rideStateMachine.Notify(ride, "COMPLETED")
 
 	writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
 		CompletedAt: ride.UpdatedAt.UnixMilli(),
 	})
 }
 
+func appPostRideCancel(w http.ResponseWriter, r *http.Request) {
+	rideID := r.PathValue("ride_id")
+	user := r.Context().Value("user").(*User)
+
+	cancelRide(w, rideID, rideActorUser, func(ride *Ride) bool {
+		return ride.UserID == user.ID
+	})
+}
+
+type appGetRideTimelineResponse struct {
+	RideID   string                           `json:"ride_id"`
+	Status   string                           `json:"status"`
+	Timeline []appGetRideTimelineResponseItem `json:"timeline"`
+}
+
+type appGetRideTimelineResponseItem struct {
+	Status    string `json:"status"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func appGetRideTimeline(w http.ResponseWriter, r *http.Request) {
+	rideID := r.PathValue("ride_id")
+	user := r.Context().Value("user").(*User)
+
+	ride := &Ride{}
+	if err := db.Get(ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if ride.UserID != user.ID {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
+
+	tx2, err := db2.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx2.Rollback()
+
+	status, err := getLatestRideStatus(tx2, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	events, err := getRideStatusEvents(tx2, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx2.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	timeline := make([]appGetRideTimelineResponseItem, 0, len(events))
+	for _, e := range events {
+		timeline = append(timeline, appGetRideTimelineResponseItem{
+			Status:    e.Status,
+			Timestamp: e.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, &appGetRideTimelineResponse{
+		RideID:   ride.ID,
+		Status:   status,
+		Timeline: timeline,
+	})
+}
+
 type appGetNotificationResponse struct {
-	Data *appGetNotificationResponseData `json:"data"`
+	Data         *appGetNotificationResponseData `json:"data,omitempty"`
+	RetryAfterMs int                             `json:"retry_after_ms"`
 }
 
 type appGetNotificationResponseData struct {
@@ -814,55 +1493,78 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int) int {
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	return initialFare + meteredFare
+// 今のルールと配車位置のサージで見積もった運賃。椅子が決まる前なのでモデルの倍率は掛けない
+type fareEstimate struct {
+	Rule  *pricing.Rule
+	Surge int
+	// 使われるクーポン。無ければ nil
+	Coupon *campaignCoupon
+	// 割引前の運賃
+	Fare int
+	// 割引後の運賃
+	Discounted int
+}
+
+// couponCode を省略したらクーポンを自動で選ぶ
+func estimateFare(tx *sqlx.Tx, userID string, couponCode string, priorRides int, rule *pricing.Rule, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (*fareEstimate, error) {
+	surgePercent, err := surge.percent(pickupLatitude, pickupLongitude)
+	if err != nil {
+		return nil, err
+	}
+	distance := calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
+	fare := rule.Fare(distance, "", surgePercent)
+	coupon, err := chooseCoupon(tx, userID, couponCode, priorRides, fare, false)
+	if err != nil {
+		return nil, err
+	}
+	return &fareEstimate{
+		Rule:       rule,
+		Surge:      surgePercent,
+		Coupon:     coupon,
+		Fare:       fare,
+		Discounted: rule.DiscountedFare(distance, "", surgePercent, couponDiscount(coupon, fare)),
+	}, nil
 }
 
+// ride が nil なら今のルールで見積もり、そうでなければライドを見積もったときのルールとサージ、割り当てられた椅子のモデルで計算する
 func calculateDiscountedFare(tx *sqlx.Tx, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
-	var coupon Coupon
-	discount := 0
-	if ride != nil {
-		destLatitude = ride.DestinationLatitude
-		destLongitude = ride.DestinationLongitude
-		pickupLatitude = ride.PickupLatitude
-		pickupLongitude = ride.PickupLongitude
-
-		// すでにクーポンが紐づいているならそれの割引額を参照
-		if err := tx.Get(&coupon, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
-		} else {
-			discount = coupon.Discount
+	if ride == nil {
+		priorRides, err := countPriorRides(db, userID, "")
+		if err != nil {
+			return 0, err
 		}
-	} else {
-		// 初回利用クーポンを最優先で使う
-		if err := tx.Get(&coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL", userID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
-
-			// 無いなら他のクーポンを付与された順番に使う
-			if err := tx.Get(&coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1", userID); err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					return 0, err
-				}
-			} else {
-				discount = coupon.Discount
-			}
-		} else {
-			discount = coupon.Discount
+		rule, err := fareRules.current()
+		if err != nil {
+			return 0, err
+		}
+		estimate, err := estimateFare(tx, userID, "", priorRides, rule, pickupLatitude, pickupLongitude, destLatitude, destLongitude)
+		if err != nil {
+			return 0, err
 		}
+		return estimate.Discounted, nil
 	}
-
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	discountedMeteredFare := max(meteredFare-discount, 0)
-
-	return initialFare + discountedMeteredFare, nil
+	rule, model, err := rideFareRule(ride)
+	if err != nil {
+		return 0, err
+	}
+	// すでにクーポンが紐づいているならそれで割り引く
+	coupon, err := rideCoupon(tx, ride.ID)
+	if err != nil {
+		return 0, err
+	}
+	return rideDiscountedFare(rule, model, ride, coupon), nil
 }
 
-var appChannels = sync.Map{}
+// ライドを見積もったときのルールとサージ、椅子のモデルで計算した割引後の運賃
+// 見積もりIDで配車したライドは見積もった運賃のまま
+func rideDiscountedFare(rule *pricing.Rule, model string, ride *Ride, coupon *campaignCoupon) int {
+	if ride.QuotedFare.Valid {
+		return int(ride.QuotedFare.Int64)
+	}
+	distance := calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	fare := rule.Fare(distance, model, ride.SurgePercent)
+	return rule.DiscountedFare(distance, model, ride.SurgePercent, couponDiscount(coupon, fare))
+}
 
 func sendNotificationSSEApp(userID string, ride *Ride, status string) {
 	if userID == "" {
@@ -874,124 +1576,129 @@ func sendNotificationSSEApp(userID string, ride *Ride, status string) {
 	if status == "" {
 		panic("status is empty")
 	}
-	if !ride.ChairID.Valid {
+	if !ride.ChairID.Valid && status != "CANCELED" {
 		slog.Warn("chairID is invalid", "ride", *ride, "status", status)
 		return
 	}
-	_ch, _ := appChannels.LoadOrStore(userID, make(chan notify, chanSize))
-	ch := _ch.(chan notify)
-	select {
-	case ch <- notify{Ride: ride, Status: status}:
-	default:
-		log.Println("dropped notification", userID, ride.ID, status)
-		// non-blocking
-	}
+	publishNotification(notificationTargetUser, userID, ride, status)
 }
 
 var chairMinimalCache = sync.Map{}
 
-func appGetNotificationSSE(w http.ResponseWriter, r *http.Request) {
+// Accept: text/event-stream ならSSE、それ以外はポーリング用のJSONを返す
+func appGetNotification(w http.ResponseWriter, r *http.Request) {
+	if acceptsEventStream(r) {
+		appGetNotificationSSE(w, r)
+		return
+	}
 	user := r.Context().Value("user").(*User)
 
-	_ch, _ := appChannels.LoadOrStore(user.ID, make(chan notify, chanSize))
-	ch := _ch.(chan notify)
+	n, pending, err := nextNotification(notificationTargetUser, user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if n == nil {
+		writeJSON(w, http.StatusOK, &appGetNotificationResponse{RetryAfterMs: notificationRetryAfterMs(nil, false)})
+		return
+	}
+	data, err := buildAppNotificationData(user, n)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &appGetNotificationResponse{
+		Data:         data,
+		RetryAfterMs: notificationRetryAfterMs(n, pending),
+	})
+}
 
-	// Server Sent Events
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
+func buildAppNotificationData(user *User, n *notify) (*appGetNotificationResponseData, error) {
+	ride := n.Ride
 
-	var lastRide *Ride
-	var lastRideStatus string
-	f := func() (respond bool, err error) {
-		slog.Debug("waiting", "user", user.ID)
-		n := <-ch
-		slog.Debug("received", "user notification", n)
-		ride := n.Ride
-		status := n.Status
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	tx2, err := db2.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx2.Rollback()
 
-		if lastRide != nil && ride.ID == lastRide.ID && status == lastRideStatus {
-			return false, nil
-		}
+	fare, err := calculateDiscountedFare(tx2, user.ID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	if err != nil {
+		return nil, err
+	}
 
-		tx, err := db.Beginx()
-		if err != nil {
-			return false, err
+	var chair *Chair
+	stats := appGetNotificationResponseChairStats{}
+	if ride.ChairID.Valid {
+		chair = &Chair{}
+		if v, ok := chairMinimalCache.Load(ride.ChairID.String); ok {
+			chair = v.(*Chair)
+		} else {
+			if err := tx.Get(chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
+				return nil, err
+			}
+			chairMinimalCache.Store(ride.ChairID.String, chair)
 		}
-		defer tx.Rollback()
-		tx2, err := db2.Beginx()
+		stats, err = getChairStats(tx, tx2, ride.ChairID.String)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
-		defer tx2.Rollback()
+	}
 
-		fare, err := calculateDiscountedFare(tx2, user.ID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-		if err != nil {
-			return false, err
+	data := &appGetNotificationResponseData{
+		RideID: ride.ID,
+		PickupCoordinate: Coordinate{
+			Latitude:  ride.PickupLatitude,
+			Longitude: ride.PickupLongitude,
+		},
+		DestinationCoordinate: Coordinate{
+			Latitude:  ride.DestinationLatitude,
+			Longitude: ride.DestinationLongitude,
+		},
+		Fare:      fare,
+		Status:    n.Status,
+		CreatedAt: ride.CreatedAt.UnixMilli(),
+		UpdateAt:  ride.UpdatedAt.UnixMilli(),
+	}
+	// マッチング前にキャンセルされたライドには椅子が無い
+	if chair != nil {
+		data.Chair = &appGetNotificationResponseChair{
+			ID:    chair.ID,
+			Name:  chair.Name,
+			Model: chair.Model,
+			Stats: stats,
 		}
+	}
+	return data, nil
+}
 
-		chair := &Chair{}
-		stats := appGetNotificationResponseChairStats{}
-		if ride.ChairID.Valid {
-			if v, ok := chairMinimalCache.Load(ride.ChairID.String); ok {
-				chair = v.(*Chair)
-			} else {
-				if err := tx.Get(chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
-					return false, err
-				}
-				chairMinimalCache.Store(ride.ChairID.String, chair)
-			}
-			stats, err = getChairStats(tx, tx2, ride.ChairID.String)
-			if err != nil {
-				return false, err
-			}
-		}
+func appGetNotificationSSE(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
 
-		if err := writeSSE(w, &appGetNotificationResponseData{
-			RideID: ride.ID,
-			PickupCoordinate: Coordinate{
-				Latitude:  ride.PickupLatitude,
-				Longitude: ride.PickupLongitude,
-			},
-			DestinationCoordinate: Coordinate{
-				Latitude:  ride.DestinationLatitude,
-				Longitude: ride.DestinationLongitude,
-			},
-			Fare:   fare,
-			Status: status,
-			Chair: &appGetNotificationResponseChair{
-				ID:    chair.ID,
-				Name:  chair.Name,
-				Model: chair.Model,
-				Stats: stats,
-			},
-			CreatedAt: ride.CreatedAt.UnixMilli(),
-			UpdateAt:  ride.UpdatedAt.UnixMilli(),
-		}); err != nil {
-			return false, err
+	var lastRide *Ride
+	var lastRideStatus string
+	f := func(n notify) error {
+		if lastRide != nil && n.Ride.ID == lastRide.ID && n.Status == lastRideStatus {
+			return nil
 		}
-		lastRide = ride
-		lastRideStatus = status
 
-		return true, nil
-	}
+		data, err := buildAppNotificationData(user, &n)
+		if err != nil {
+			return err
+		}
+		if err := writeSSE(w, n.ID, data); err != nil {
+			return err
+		}
+		lastRide = n.Ride
+		lastRideStatus = n.Status
 
-	// 初回送信を必ず行う
-	if err := writeSSE(w, nil); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to send sse at first: %w", err))
-		return
+		return nil
 	}
 
-	for {
-		select {
-		case <-r.Context().Done():
-			return
-
-		default:
-			_, err := f()
-			if err != nil {
-				slog.Warn("failed to send sse:", "error", err)
-				return
-			}
-		}
-	}
+	streamNotifications(w, r, notificationTargetUser, user.ID, f)
 }
@@ -6,13 +6,11 @@ import (
 	"fmt"
 	"hash/fnv"
 	"io"
-	"log"
 	"log/slog"
 	"net/http"
 	"sync"
 	"time"
 
-	"github.com/goccy/go-json"
 	"github.com/oklog/ulid/v2"
 )
 
@@ -219,14 +217,24 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 		if status != "COMPLETED" && status != "CANCELED" {
 			if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == "ENROUTE" {
 				// rideStatusCache.Store(ride.ID, rideStatus{Status: "PICKUP", UpdatedAt: time.Now()})
-				tx2.Exec("UPDATE ride_status SET status = 'PICKUP' WHERE ride_id = ?", ride.ID)
 				newStatus = "PICKUP"
 			}
 			if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && status == "CARRYING" {
 				// rideStatusCache.Store(ride.ID, rideStatus{Status: "ARRIVED", UpdatedAt: time.Now()})
-				tx2.Exec("UPDATE ride_status SET status = 'ARRIVED' WHERE ride_id = ?", ride.ID)
 				newStatus = "ARRIVED"
 			}
+			if newStatus != "" {
+				if _, err := rideStateMachine.Transition(tx2, ride.ID, newStatus, rideActorChairLocation); err != nil {
+					var te *rideTransitionError
+					if !errors.As(err, &te) {
+						writeError(w, http.StatusInternalServerError, err)
+						return
+					}
+					// 他のリクエストが先に状態を変えていた
+					slog.Warn("skipped ride status transition", "error", err)
+					newStatus = ""
+				}
+			}
 		}
 	}
 	if err := tx2.Commit(); err != nil {
@@ -234,8 +242,7 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if newStatus != "" {
-		go sendNotificationSSE(chair.ID, ride, newStatus)
-		go sendNotificationSSEApp(ride.UserID, ride, newStatus)
+		go rideStateMachine.Notify(ride, newStatus)
 	}
 	wg.Wait()
 
@@ -249,7 +256,8 @@ type simpleUser struct {
 }
 
 type chairGetNotificationResponse struct {
-	Data *chairGetNotificationResponseData `json:"data"`
+	Data         *chairGetNotificationResponseData `json:"data,omitempty"`
+	RetryAfterMs int                               `json:"retry_after_ms"`
 }
 
 type chairGetNotificationResponseData struct {
@@ -274,6 +282,18 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
+	// PICKUP, ARRIVED は座標を送ったときに到着を確かめて変える。キャンセルはクーポンや与信も戻すので cancelRide で行う
+	switch req.Status {
+	case "ENROUTE", "CARRYING":
+	case "CANCELED":
+		cancelRide(w, rideID, rideActorChair, func(ride *Ride) bool {
+			return ride.ChairID.Valid && ride.ChairID.String == chair.ID
+		})
+		return
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("invalid status"))
+		return
+	}
 
 	ride := &Ride{}
 	if err := db.Get(ride, "SELECT * FROM rides WHERE id = ?", rideID); err != nil {
@@ -290,50 +310,38 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	newStatus := ""
-	switch req.Status {
-	// Acknowledge the ride
-	case "ENROUTE":
-		// rideStatusCache.Store(ride.ID, rideStatus{Status: "ENROUTE", UpdatedAt: time.Now()})
-		db2.Exec("UPDATE ride_status SET status = 'ENROUTE' WHERE ride_id = ?", ride.ID)
-		newStatus = "ENROUTE"
-	// After Picking up user
-	case "CARRYING":
-		status, err := getLatestRideStatus(db2, ride.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		if status != "PICKUP" {
-			writeError(w, http.StatusBadRequest, errors.New("chair has not arrived yet"))
-			return
-		}
-		// rideStatusCache.Store(ride.ID, rideStatus{Status: "CARRYING", UpdatedAt: time.Now()})
-		db2.Exec("UPDATE ride_status SET status = 'CARRYING' WHERE ride_id = ?", ride.ID)
-		newStatus = "CARRYING"
-	default:
-		writeError(w, http.StatusBadRequest, errors.New("invalid status"))
+	tx2, err := db2.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
+	defer tx2.Rollback()
 
-	if newStatus != "" {
-		sendNotificationSSE(chair.ID, ride, req.Status)
-		sendNotificationSSEApp(ride.UserID, ride, req.Status)
+	if _, err := rideStateMachine.Transition(tx2, ride.ID, req.Status, rideActorChair); err != nil {
+		writeRideTransitionError(w, err)
+		return
+	}
+	if err := tx2.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
 
+	rideStateMachine.Notify(ride, req.Status)
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
-var chairChannels = sync.Map{}
+func chairPostRideCancel(w http.ResponseWriter, r *http.Request) {
+	rideID := r.PathValue("ride_id")
+	chair := r.Context().Value("chair").(*Chair)
 
-type notify struct {
-	Ride   *Ride
-	Status string
+	cancelRide(w, rideID, rideActorChair, func(ride *Ride) bool {
+		return ride.ChairID.Valid && ride.ChairID.String == chair.ID
+	})
 }
 
 var usersMinimalCache = sync.Map{}
 
-const chanSize = 60
-
 func sendNotificationSSE(chairID string, ride *Ride, status string) {
 	if chairID == "" {
 		panic("chairID is empty")
@@ -344,109 +352,102 @@ func sendNotificationSSE(chairID string, ride *Ride, status string) {
 	if status == "" {
 		panic("status is empty")
 	}
-	_ch, _ := chairChannels.LoadOrStore(chairID, make(chan notify, chanSize))
-	ch := _ch.(chan notify)
-	select {
-	case ch <- notify{Ride: ride, Status: status}:
-	default:
-		log.Println("dropped notification", chairID, ride.ID, status)
-		// non-blocking
-	}
+	publishNotification(notificationTargetChair, chairID, ride, status)
 }
 
-func chairGetNotificationSSE(w http.ResponseWriter, r *http.Request) {
+// Accept: text/event-stream ならSSE、それ以外はポーリング用のJSONを返す
+func chairGetNotification(w http.ResponseWriter, r *http.Request) {
+	if acceptsEventStream(r) {
+		chairGetNotificationSSE(w, r)
+		return
+	}
 	chair := r.Context().Value("chair").(*Chair)
 
-	_ch, _ := chairChannels.LoadOrStore(chair.ID, make(chan notify, chanSize))
-	ch := _ch.(chan notify)
-
-	// Server Sent Events
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-
-	var lastRide *Ride
-	var lastRideStatus string
-	f := func() (respond bool, err error) {
-		slog.Debug("waiting", "chair", chair.ID)
-		n := <-ch
-		slog.Debug("received", "notification", n)
-		ride := n.Ride
-		status := n.Status
-
-		if lastRide != nil && ride.ID == lastRide.ID && status == lastRideStatus {
-			return false, nil
-		}
-
-		user := &User{}
-		if u, ok := usersMinimalCache.Load(ride.UserID); ok {
-			user = u.(*User)
-		} else {
-			if err := db.Get(user, "SELECT id, firstname, lastname FROM users WHERE id = ?", ride.UserID); err != nil {
-				return false, fmt.Errorf("failed to get user id=%s: %w", ride.UserID, err)
-			}
-			usersMinimalCache.Store(ride.UserID, user)
-		}
-
-		if err := writeSSE(w, &chairGetNotificationResponseData{
-			RideID: ride.ID,
-			User: simpleUser{
-				ID:   user.ID,
-				Name: fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
-			},
-			PickupCoordinate: Coordinate{
-				Latitude:  ride.PickupLatitude,
-				Longitude: ride.PickupLongitude,
-			},
-			DestinationCoordinate: Coordinate{
-				Latitude:  ride.DestinationLatitude,
-				Longitude: ride.DestinationLongitude,
-			},
-			Status: status,
-		}); err != nil {
-			return false, fmt.Errorf("failed to writeSSE: %w", err)
-		}
-		lastRide = ride
-		lastRideStatus = status
-		if status == "COMPLETED" {
-			chairsInRide.Delete(chair.ID)
-		}
-		return true, nil
+	n, pending, err := nextNotification(notificationTargetChair, chair.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
-
-	// 初回送信を必ず行う
-	if err := writeSSE(w, nil); err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to send sse at first: %w", err))
+	if n == nil {
+		writeJSON(w, http.StatusOK, &chairGetNotificationResponse{RetryAfterMs: notificationRetryAfterMs(nil, false)})
+		return
+	}
+	data, err := buildChairNotificationData(n)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	releaseChairAfterNotification(chair, n)
+	writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
+		Data:         data,
+		RetryAfterMs: notificationRetryAfterMs(n, pending),
+	})
+}
 
-	for {
-		select {
-		case <-r.Context().Done():
-			return
+func buildChairNotificationData(n *notify) (*chairGetNotificationResponseData, error) {
+	ride := n.Ride
 
-		default:
-			_, err := f()
-			if err != nil {
-				slog.Warn("failed to send sse:", "error", err)
-				return
-			}
+	user := &User{}
+	if u, ok := usersMinimalCache.Load(ride.UserID); ok {
+		user = u.(*User)
+	} else {
+		if err := db.Get(user, "SELECT id, firstname, lastname FROM users WHERE id = ?", ride.UserID); err != nil {
+			return nil, fmt.Errorf("failed to get user id=%s: %w", ride.UserID, err)
 		}
+		usersMinimalCache.Store(ride.UserID, user)
 	}
+
+	return &chairGetNotificationResponseData{
+		RideID: ride.ID,
+		User: simpleUser{
+			ID:   user.ID,
+			Name: fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
+		},
+		PickupCoordinate: Coordinate{
+			Latitude:  ride.PickupLatitude,
+			Longitude: ride.PickupLongitude,
+		},
+		DestinationCoordinate: Coordinate{
+			Latitude:  ride.DestinationLatitude,
+			Longitude: ride.DestinationLongitude,
+		},
+		Status: n.Status,
+	}, nil
 }
 
-func writeSSE(w http.ResponseWriter, data interface{}) error {
-	buf, err := json.Marshal(data)
-	if err != nil {
-		return err
+// ライドが終わったことを椅子に伝えたら、次のマッチングの対象に戻す
+func releaseChairAfterNotification(chair *Chair, n *notify) {
+	if n.Status != "COMPLETED" && n.Status != "CANCELED" {
+		return
 	}
-	_, err = w.Write([]byte("data: " + string(buf) + "\n\n"))
-	if err != nil {
-		return err
+	// 再送した古い通知で、今のライドを解放しないようにする
+	if v, ok := chairsInRide.Load(chair.ID); ok && v.(*Ride).ID == n.Ride.ID {
+		chairsInRide.Delete(chair.ID)
 	}
+}
 
-	if f, ok := w.(http.Flusher); ok {
-		f.Flush()
+func chairGetNotificationSSE(w http.ResponseWriter, r *http.Request) {
+	chair := r.Context().Value("chair").(*Chair)
+
+	var lastRide *Ride
+	var lastRideStatus string
+	f := func(n notify) error {
+		if lastRide != nil && n.Ride.ID == lastRide.ID && n.Status == lastRideStatus {
+			return nil
+		}
+
+		data, err := buildChairNotificationData(&n)
+		if err != nil {
+			return err
+		}
+		if err := writeSSE(w, n.ID, data); err != nil {
+			return fmt.Errorf("failed to writeSSE: %w", err)
+		}
+		lastRide = n.Ride
+		lastRideStatus = n.Status
+		releaseChairAfterNotification(chair, &n)
+		return nil
 	}
 
-	return nil
+	streamNotifications(w, r, notificationTargetChair, chair.ID, f)
 }
@@ -0,0 +1,201 @@
+// matchsim はDBのスナップショットを使って、マッチング戦略をオフラインで比較する
+//
+//	go run ./cmd/matchsim -strategy greedy,hungarian ../sql/2-master-data.sql ../sql/3-initial-data.sql.gz
+//
+// スナップショットは rides, chairs, chair_models, ride_status(またはride_statuses, ride_status_events) を含む
+// mysqldump形式のSQL、もしくは同じ列名をキーにしたJSON。末尾が.gzなら展開して読む
+// 複数のファイルを渡すと、それらをまとめて1つのスナップショットとして扱う
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/isucon/isucon14/webapp/go/matcher"
+)
+
+func main() {
+	snapshotPaths := flag.String("snapshot", "", "comma separated snapshot files (.json or .sql, optionally .gz); positional arguments are also accepted")
+	strategies := flag.String("strategy", strings.Join(matcher.Strategies(), ","), "comma separated matching strategies to compare")
+	tick := flag.Duration("tick", 100*time.Millisecond, "simulated time per chair movement step")
+	interval := flag.Duration("interval", defaultInterval(), "simulated time between matching runs (default: ISUCON_MATCHING_INTERVAL)")
+	timeout := flag.Duration("timeout", 30*time.Minute, "stop simulating this long after the last ride request")
+	statuses := flag.String("status", "", "only simulate rides whose latest status is one of these (comma separated, default: all but CANCELED)")
+	allChairs := flag.Bool("all-chairs", false, "include inactive chairs")
+	asJSON := flag.Bool("json", false, "print reports as JSON")
+	flag.Parse()
+
+	paths := flag.Args()
+	if *snapshotPaths != "" {
+		paths = append(strings.Split(*snapshotPaths, ","), paths...)
+	}
+	if len(paths) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *tick <= 0 || *interval <= 0 {
+		log.Fatal("tick and interval must be positive")
+	}
+
+	s := &snapshot{}
+	for _, path := range paths {
+		part, err := loadSnapshot(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.merge(part)
+	}
+	rides := buildRides(s, *statuses)
+	chairs := buildChairs(s, *allChairs, rides)
+	log.Printf("loaded %d rides, %d chairs from %s", len(rides), len(chairs), strings.Join(paths, ", "))
+
+	cfg := simConfig{Tick: *tick, Interval: *interval, Timeout: *timeout}
+	reports := []*simReport{}
+	for _, name := range strings.Split(*strategies, ",") {
+		name = strings.TrimSpace(name)
+		m, err := matcher.New(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reports = append(reports, simulate(name, m, rides, chairs, cfg))
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(reports); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	printReports(reports)
+}
+
+func defaultInterval() time.Duration {
+	if v := os.Getenv("ISUCON_MATCHING_INTERVAL"); v != "" {
+		if sec, err := strconv.ParseFloat(v, 64); err == nil && sec > 0 {
+			return time.Duration(sec * float64(time.Second))
+		}
+	}
+	return 500 * time.Millisecond
+}
+
+func buildRides(s *snapshot, statuses string) []*matcher.Ride {
+	// ride_statusは履歴の場合もあるので、最新の状態だけを見る
+	latest := map[string]rideStatusRow{}
+	for _, st := range s.RideStatus {
+		if cur, ok := latest[st.RideID]; !ok || !st.UpdatedAt.Before(cur.UpdatedAt) {
+			latest[st.RideID] = st
+		}
+	}
+	allowed := map[string]bool{}
+	for _, st := range strings.Split(statuses, ",") {
+		if st = strings.TrimSpace(st); st != "" {
+			allowed[strings.ToUpper(st)] = true
+		}
+	}
+
+	rides := make([]*matcher.Ride, 0, len(s.Rides))
+	for _, r := range s.Rides {
+		status := latest[r.ID].Status
+		if len(allowed) > 0 {
+			if !allowed[status] {
+				continue
+			}
+		} else if status == "CANCELED" {
+			continue
+		}
+		rides = append(rides, &matcher.Ride{
+			ID:                   r.ID,
+			PickupLatitude:       r.PickupLatitude,
+			PickupLongitude:      r.PickupLongitude,
+			DestinationLatitude:  r.DestinationLatitude,
+			DestinationLongitude: r.DestinationLongitude,
+			CreatedAt:            r.CreatedAt,
+		})
+	}
+	sort.Slice(rides, func(i, j int) bool { return rides[i].ID < rides[j].ID })
+	return rides
+}
+
+// 椅子の初期位置は chairs.latitude/longitude、無ければシミュレーション開始時点の chair_locations を使う
+func buildChairs(s *snapshot, all bool, rides []*matcher.Ride) []*matcher.Chair {
+	speeds := map[string]int{}
+	for _, m := range s.ChairModels {
+		speeds[m.Name] = m.Speed
+	}
+
+	var start time.Time
+	for _, r := range rides {
+		if start.IsZero() || r.CreatedAt.Before(start) {
+			start = r.CreatedAt
+		}
+	}
+	locations := map[string]chairLocationRow{}
+	for _, l := range s.ChairLocations {
+		cur, ok := locations[l.ChairID]
+		switch {
+		case !ok:
+			locations[l.ChairID] = l
+		case l.CreatedAt.After(start):
+			// 開始時点より後の位置は、それしか無い場合だけ使う
+			if cur.CreatedAt.After(start) && l.CreatedAt.Before(cur.CreatedAt) {
+				locations[l.ChairID] = l
+			}
+		case cur.CreatedAt.After(start) || l.CreatedAt.After(cur.CreatedAt):
+			locations[l.ChairID] = l
+		}
+	}
+
+	chairs := make([]*matcher.Chair, 0, len(s.Chairs))
+	unknownModel, unplaced := 0, 0
+	for _, c := range s.Chairs {
+		if !all && !c.IsActive {
+			continue
+		}
+		speed, ok := speeds[c.Model]
+		if !ok {
+			unknownModel++
+			speed = 1
+		}
+		chair := &matcher.Chair{ID: c.ID, Speed: speed}
+		if c.Latitude != nil && c.Longitude != nil {
+			chair.Latitude, chair.Longitude = *c.Latitude, *c.Longitude
+		} else if l, ok := locations[c.ID]; ok {
+			chair.Latitude, chair.Longitude = l.Latitude, l.Longitude
+		} else {
+			unplaced++
+		}
+		chairs = append(chairs, chair)
+	}
+	if unknownModel > 0 {
+		log.Printf("%d chairs have an unknown model; using speed 1", unknownModel)
+	}
+	if unplaced > 0 {
+		log.Printf("%d chairs have no location; placing them at (0, 0)", unplaced)
+	}
+	sort.Slice(chairs, func(i, j int) bool { return chairs[i].ID < chairs[j].ID })
+	return chairs
+}
+
+func printReports(reports []*simReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "strategy\trides\tmatched\tcompleted\twait p50\twait p90\twait p99\twait max\tmatch p50\tmatch p90\tidle ratio\tpickup dist\tpickup avg\trevenue\t")
+	for _, r := range reports {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.1fs\t%.1fs\t%.1fs\t%.1fs\t%.1fs\t%.1fs\t%.3f\t%d\t%.1f\t%d\t\n",
+			r.Strategy, r.Rides, r.Matched, r.Completed,
+			r.WaitP50, r.WaitP90, r.WaitP99, r.WaitMax,
+			r.MatchWaitP50, r.MatchWaitP90,
+			r.IdleChairRatio, r.PickupDistanceTotal, r.PickupDistanceAvg, r.Revenue,
+		)
+	}
+	w.Flush()
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/isucon/isucon14/webapp/go/matcher"
+	"github.com/isucon/isucon14/webapp/go/pricing"
+)
+
+type simConfig struct {
+	// 椅子が1回移動する(速度分だけ進む)間隔
+	Tick time.Duration
+	// マッチングを実行する間隔
+	Interval time.Duration
+	// 最後のライド要求からこの時間が経っても終わらなければ打ち切る
+	Timeout time.Duration
+}
+
+type chairState int
+
+const (
+	chairIdle chairState = iota
+	chairEnroute
+	chairCarrying
+)
+
+type simChair struct {
+	chair *matcher.Chair
+	state chairState
+	ride  *simRide
+}
+
+type simRide struct {
+	ride        *matcher.Ride
+	matchedAt   time.Time
+	pickedUpAt  time.Time
+	completedAt time.Time
+}
+
+type simReport struct {
+	Strategy  string `json:"strategy"`
+	Rides     int    `json:"rides"`
+	Matched   int    `json:"matched"`
+	Completed int    `json:"completed"`
+	// ライド要求から椅子が配車位置に着くまでの秒数
+	WaitP50 float64 `json:"wait_p50"`
+	WaitP90 float64 `json:"wait_p90"`
+	WaitP99 float64 `json:"wait_p99"`
+	WaitMax float64 `json:"wait_max"`
+	// ライド要求から椅子が割り当てられるまでの秒数
+	MatchWaitP50 float64 `json:"match_wait_p50"`
+	MatchWaitP90 float64 `json:"match_wait_p90"`
+	// 稼働中の椅子のうち空いていた割合の時間平均
+	IdleChairRatio      float64 `json:"idle_chair_ratio"`
+	PickupDistanceTotal int     `json:"pickup_distance_total"`
+	PickupDistanceAvg   float64 `json:"pickup_distance_avg"`
+	// 完了したライドの運賃(割引前)の合計
+	Revenue int `json:"revenue"`
+	// シミュレーション上の経過時間
+	SimulatedSeconds float64 `json:"simulated_seconds"`
+}
+
+// スナップショットのライド要求を作成日時の順に流し込み、指定した戦略でマッチングしながら椅子を動かす
+func simulate(name string, m matcher.Matcher, rides []*matcher.Ride, chairs []*matcher.Chair, cfg simConfig) *simReport {
+	report := &simReport{Strategy: name, Rides: len(rides)}
+	if len(rides) == 0 {
+		return report
+	}
+
+	// 入力を戦略間で共有するので、椅子の位置はコピーしてから動かす
+	simChairs := make([]*simChair, 0, len(chairs))
+	for _, c := range chairs {
+		cc := *c
+		simChairs = append(simChairs, &simChair{chair: &cc})
+	}
+	simRides := make([]*simRide, 0, len(rides))
+	for _, r := range rides {
+		simRides = append(simRides, &simRide{ride: r})
+	}
+	sort.SliceStable(simRides, func(i, j int) bool {
+		return simRides[i].ride.CreatedAt.Before(simRides[j].ride.CreatedAt)
+	})
+
+	start := simRides[0].ride.CreatedAt
+	deadline := simRides[len(simRides)-1].ride.CreatedAt.Add(cfg.Timeout)
+	nextMatching := start
+	next := 0
+	pending := []*simRide{}
+	var idleSum float64
+	ticks := 0
+
+	now := start
+	for ; !now.After(deadline); now = now.Add(cfg.Tick) {
+		for next < len(simRides) && !simRides[next].ride.CreatedAt.After(now) {
+			pending = append(pending, simRides[next])
+			next++
+		}
+
+		for _, c := range simChairs {
+			c.move(now, report)
+		}
+
+		if !now.Before(nextMatching) {
+			pending = match(now, m, pending, simChairs, report)
+			nextMatching = nextMatching.Add(cfg.Interval)
+		}
+
+		idle := 0
+		for _, c := range simChairs {
+			if c.state == chairIdle {
+				idle++
+			}
+		}
+		if len(simChairs) > 0 {
+			idleSum += float64(idle) / float64(len(simChairs))
+		}
+		ticks++
+
+		if next == len(simRides) && report.Completed == report.Matched && len(pending) == 0 {
+			break
+		}
+	}
+	report.SimulatedSeconds = now.Sub(start).Seconds()
+	if ticks > 0 {
+		report.IdleChairRatio = idleSum / float64(ticks)
+	}
+	if report.Matched > 0 {
+		report.PickupDistanceAvg = float64(report.PickupDistanceTotal) / float64(report.Matched)
+	}
+
+	waits := []float64{}
+	matchWaits := []float64{}
+	for _, r := range simRides {
+		if !r.matchedAt.IsZero() {
+			matchWaits = append(matchWaits, r.matchedAt.Sub(r.ride.CreatedAt).Seconds())
+		}
+		if !r.pickedUpAt.IsZero() {
+			waits = append(waits, r.pickedUpAt.Sub(r.ride.CreatedAt).Seconds())
+		}
+	}
+	report.WaitP50 = percentile(waits, 50)
+	report.WaitP90 = percentile(waits, 90)
+	report.WaitP99 = percentile(waits, 99)
+	report.WaitMax = percentile(waits, 100)
+	report.MatchWaitP50 = percentile(matchWaits, 50)
+	report.MatchWaitP90 = percentile(matchWaits, 90)
+	return report
+}
+
+func match(now time.Time, m matcher.Matcher, pending []*simRide, chairs []*simChair, report *simReport) []*simRide {
+	if len(pending) == 0 {
+		return pending
+	}
+	free := []*matcher.Chair{}
+	chairByID := map[string]*simChair{}
+	for _, c := range chairs {
+		if c.state == chairIdle {
+			free = append(free, c.chair)
+			chairByID[c.chair.ID] = c
+		}
+	}
+	if len(free) == 0 {
+		return pending
+	}
+	rides := make([]*matcher.Ride, 0, len(pending))
+	rideByID := map[string]*simRide{}
+	for _, r := range pending {
+		rides = append(rides, r.ride)
+		rideByID[r.ride.ID] = r
+	}
+
+	for _, a := range m.Match(now, rides, free) {
+		c, r := chairByID[a.Chair.ID], rideByID[a.Ride.ID]
+		if c == nil || r == nil || c.state != chairIdle || !r.matchedAt.IsZero() {
+			panic(fmt.Sprintf("matcher returned an invalid assignment: ride=%s chair=%s", a.Ride.ID, a.Chair.ID))
+		}
+		c.state = chairEnroute
+		c.ride = r
+		r.matchedAt = now
+		report.Matched++
+		report.PickupDistanceTotal += a.PD
+	}
+
+	remaining := pending[:0]
+	for _, r := range pending {
+		if r.matchedAt.IsZero() {
+			remaining = append(remaining, r)
+		}
+	}
+	return remaining
+}
+
+// 目的地に向かって速度分だけ進む。緯度方向を先に合わせる
+func (c *simChair) move(now time.Time, report *simReport) {
+	if c.state == chairIdle {
+		return
+	}
+	r := c.ride.ride
+	targetLat, targetLon := r.PickupLatitude, r.PickupLongitude
+	if c.state == chairCarrying {
+		targetLat, targetLon = r.DestinationLatitude, r.DestinationLongitude
+	}
+
+	step := max(c.chair.Speed, 1)
+	for step > 0 && (c.chair.Latitude != targetLat || c.chair.Longitude != targetLon) {
+		if c.chair.Latitude != targetLat {
+			d := min(step, abs(targetLat-c.chair.Latitude))
+			c.chair.Latitude += sign(targetLat-c.chair.Latitude) * d
+			step -= d
+			continue
+		}
+		d := min(step, abs(targetLon-c.chair.Longitude))
+		c.chair.Longitude += sign(targetLon-c.chair.Longitude) * d
+		step -= d
+	}
+	if c.chair.Latitude != targetLat || c.chair.Longitude != targetLon {
+		return
+	}
+
+	switch c.state {
+	case chairEnroute:
+		c.ride.pickedUpAt = now
+		c.state = chairCarrying
+	case chairCarrying:
+		c.ride.completedAt = now
+		report.Completed++
+		report.Revenue += pricing.Fare(matcher.Distance(r.PickupLatitude, r.PickupLongitude, r.DestinationLatitude, r.DestinationLongitude))
+		c.state = chairIdle
+		c.ride = nil
+	}
+}
+
+// nearest-rank法でパーセンタイルを求める
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	rank = min(max(rank, 1), len(sorted))
+	return sorted[rank-1]
+}
+
+func abs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+func sign(a int) int {
+	if a < 0 {
+		return -1
+	}
+	return 1
+}
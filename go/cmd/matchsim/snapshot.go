@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// シミュレーションの入力となるDBのスナップショット
+// JSONの場合はこの構造体そのまま、SQLダンプの場合はINSERT文から組み立てる
+type snapshot struct {
+	ChairModels    []chairModelRow    `json:"chair_models"`
+	Chairs         []chairRow         `json:"chairs"`
+	ChairLocations []chairLocationRow `json:"chair_locations"`
+	Rides          []rideRow          `json:"rides"`
+	RideStatus     []rideStatusRow    `json:"ride_status"`
+}
+
+type chairModelRow struct {
+	Name  string `json:"name"`
+	Speed int    `json:"speed"`
+}
+
+type chairRow struct {
+	ID        string    `json:"id"`
+	Model     string    `json:"model"`
+	IsActive  bool      `json:"is_active"`
+	Latitude  *int      `json:"latitude"`
+	Longitude *int      `json:"longitude"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type chairLocationRow struct {
+	ChairID   string    `json:"chair_id"`
+	Latitude  int       `json:"latitude"`
+	Longitude int       `json:"longitude"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type rideRow struct {
+	ID                   string    `json:"id"`
+	UserID               string    `json:"user_id"`
+	PickupLatitude       int       `json:"pickup_latitude"`
+	PickupLongitude      int       `json:"pickup_longitude"`
+	DestinationLatitude  int       `json:"destination_latitude"`
+	DestinationLongitude int       `json:"destination_longitude"`
+	CreatedAt            time.Time `json:"created_at"`
+}
+
+type rideStatusRow struct {
+	RideID    string    `json:"ride_id"`
+	Status    string    `json:"status"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (s *snapshot) merge(o *snapshot) {
+	s.ChairModels = append(s.ChairModels, o.ChairModels...)
+	s.Chairs = append(s.Chairs, o.Chairs...)
+	s.ChairLocations = append(s.ChairLocations, o.ChairLocations...)
+	s.Rides = append(s.Rides, o.Rides...)
+	s.RideStatus = append(s.RideStatus, o.RideStatus...)
+}
+
+func loadSnapshot(path string) (*snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	name := path
+	if strings.HasSuffix(name, ".gz") {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+		name = strings.TrimSuffix(name, ".gz")
+	}
+
+	switch {
+	case strings.HasSuffix(name, ".json"):
+		s := &snapshot{}
+		if err := json.NewDecoder(r).Decode(s); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+		return s, nil
+	case strings.HasSuffix(name, ".sql"):
+		return loadSQLDump(r)
+	default:
+		return nil, fmt.Errorf("unsupported snapshot format: %s (expected .json or .sql, optionally .gz)", path)
+	}
+}
+
+// CREATE TABLE が無いダンプ向けの列順 (1-schema.sql に 5.sql を適用したもの)
+var defaultColumns = map[string][]string{
+	"chair_models":       {"name", "speed"},
+	"chairs":             {"id", "owner_id", "name", "model", "is_active", "access_token", "created_at", "updated_at", "total_distance", "moved_at", "latitude", "longitude"},
+	"chair_locations":    {"id", "chair_id", "latitude", "longitude", "created_at"},
+	"rides":              {"id", "user_id", "chair_id", "pickup_latitude", "pickup_longitude", "destination_latitude", "destination_longitude", "evaluation", "created_at", "updated_at", "canceled_at", "payment_idempotency_key", "fare_rule_version", "surge_percent", "sale", "quoted_fare", "quote_id"},
+	"ride_status":        {"ride_id", "status", "updated_at"},
+	"ride_statuses":      {"id", "ride_id", "status", "created_at", "app_sent_at", "chair_sent_at"},
+	"ride_status_events": {"id", "ride_id", "status", "created_at"},
+}
+
+// mysqldump形式のSQLから必要なテーブルの行だけを読み出す
+func loadSQLDump(r io.Reader) (*snapshot, error) {
+	columns := map[string][]string{}
+	for table, cols := range defaultColumns {
+		columns[table] = cols
+	}
+
+	s := &snapshot{}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 1024*1024), 256*1024*1024)
+	var creating string
+	var createCols []string
+	var inserting strings.Builder
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+
+		// INSERT文は複数行にまたがることがあるので、;まで溜めてから処理する
+		if inserting.Len() > 0 {
+			inserting.WriteString(" ")
+			inserting.WriteString(line)
+			if strings.HasSuffix(line, ";") {
+				if err := s.addInsert(inserting.String(), columns); err != nil {
+					return nil, err
+				}
+				inserting.Reset()
+			}
+			continue
+		}
+
+		if creating != "" {
+			if strings.HasPrefix(line, ")") {
+				columns[creating] = createCols
+				creating = ""
+				continue
+			}
+			if col := columnName(line); col != "" {
+				createCols = append(createCols, col)
+			}
+			continue
+		}
+
+		upper := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(upper, "CREATE TABLE"):
+			creating = tableName(line[len("CREATE TABLE"):])
+			createCols = nil
+		case strings.HasPrefix(upper, "INSERT INTO"):
+			if !strings.HasSuffix(line, ";") {
+				inserting.WriteString(line[len("INSERT INTO"):])
+				continue
+			}
+			if err := s.addInsert(line[len("INSERT INTO"):], columns); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func tableName(s string) string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "IF NOT EXISTS ")
+	if i := strings.IndexAny(s, " ("); i >= 0 {
+		s = s[:i]
+	}
+	return strings.Trim(s, "`")
+}
+
+func columnName(line string) string {
+	if line == "" || line == "(" {
+		return ""
+	}
+	fields := strings.Fields(line)
+	switch strings.ToUpper(fields[0]) {
+	case "PRIMARY", "KEY", "UNIQUE", "INDEX", "CONSTRAINT", "FOREIGN", "FULLTEXT", "CHECK":
+		return ""
+	}
+	return strings.Trim(fields[0], "`(")
+}
+
+func (s *snapshot) addInsert(stmt string, columns map[string][]string) error {
+	stmt = strings.TrimSpace(stmt)
+	table := tableName(stmt)
+	cols, ok := columns[table]
+	if !ok {
+		return nil
+	}
+	rest := strings.TrimSpace(stmt[strings.Index(stmt, table)+len(table):])
+	rest = strings.TrimPrefix(rest, "`")
+	rest = strings.TrimSpace(rest)
+	if strings.HasPrefix(rest, "(") {
+		// INSERT INTO t (a, b) VALUES ...
+		end := strings.Index(rest, ")")
+		cols = nil
+		for _, c := range strings.Split(rest[1:end], ",") {
+			cols = append(cols, strings.Trim(strings.TrimSpace(c), "`"))
+		}
+		rest = strings.TrimSpace(rest[end+1:])
+	}
+	if !strings.HasPrefix(strings.ToUpper(rest), "VALUES") {
+		return fmt.Errorf("unsupported INSERT statement for %s", table)
+	}
+	tuples, err := parseValues(rest[len("VALUES"):])
+	if err != nil {
+		return fmt.Errorf("failed to parse INSERT for %s: %w", table, err)
+	}
+
+	for _, tuple := range tuples {
+		row := map[string]*string{}
+		for i, v := range tuple {
+			if i < len(cols) {
+				row[cols[i]] = v
+			}
+		}
+		if err := s.addRow(table, row); err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func (s *snapshot) addRow(table string, row map[string]*string) error {
+	str := func(name string) string {
+		if v := row[name]; v != nil {
+			return *v
+		}
+		return ""
+	}
+	var err error
+	num := func(name string) int {
+		v := row[name]
+		if v == nil {
+			return 0
+		}
+		n, e := strconv.Atoi(*v)
+		if e != nil && err == nil {
+			err = fmt.Errorf("invalid %s: %q", name, *v)
+		}
+		return n
+	}
+	optNum := func(name string) *int {
+		if row[name] == nil {
+			return nil
+		}
+		n := num(name)
+		return &n
+	}
+	ts := func(name string) time.Time {
+		v := row[name]
+		if v == nil {
+			return time.Time{}
+		}
+		t, e := time.Parse("2006-01-02 15:04:05.999999", *v)
+		if e != nil && err == nil {
+			err = fmt.Errorf("invalid %s: %q", name, *v)
+		}
+		return t
+	}
+
+	switch table {
+	case "chair_models":
+		s.ChairModels = append(s.ChairModels, chairModelRow{Name: str("name"), Speed: num("speed")})
+	case "chairs":
+		s.Chairs = append(s.Chairs, chairRow{
+			ID:        str("id"),
+			Model:     str("model"),
+			IsActive:  str("is_active") == "1",
+			Latitude:  optNum("latitude"),
+			Longitude: optNum("longitude"),
+			CreatedAt: ts("created_at"),
+		})
+	case "chair_locations":
+		s.ChairLocations = append(s.ChairLocations, chairLocationRow{
+			ChairID:   str("chair_id"),
+			Latitude:  num("latitude"),
+			Longitude: num("longitude"),
+			CreatedAt: ts("created_at"),
+		})
+	case "rides":
+		s.Rides = append(s.Rides, rideRow{
+			ID:                   str("id"),
+			UserID:               str("user_id"),
+			PickupLatitude:       num("pickup_latitude"),
+			PickupLongitude:      num("pickup_longitude"),
+			DestinationLatitude:  num("destination_latitude"),
+			DestinationLongitude: num("destination_longitude"),
+			CreatedAt:            ts("created_at"),
+		})
+	case "ride_status":
+		s.RideStatus = append(s.RideStatus, rideStatusRow{RideID: str("ride_id"), Status: str("status"), UpdatedAt: ts("updated_at")})
+	case "ride_statuses", "ride_status_events":
+		s.RideStatus = append(s.RideStatus, rideStatusRow{RideID: str("ride_id"), Status: str("status"), UpdatedAt: ts("created_at")})
+	}
+	return err
+}
+
+// VALUES (...),(...); をパースする。NULLはnilになる
+func parseValues(s string) ([][]*string, error) {
+	var tuples [][]*string
+	i := 0
+	skipSpace := func() {
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r') {
+			i++
+		}
+	}
+	for {
+		skipSpace()
+		if i >= len(s) || s[i] == ';' {
+			return tuples, nil
+		}
+		if s[i] == ',' {
+			i++
+			continue
+		}
+		if s[i] != '(' {
+			return nil, fmt.Errorf("unexpected %q at %d", s[i], i)
+		}
+		i++
+		var tuple []*string
+		for {
+			skipSpace()
+			if i >= len(s) {
+				return nil, errors.New("unterminated tuple")
+			}
+			switch s[i] {
+			case ')':
+				i++
+				tuples = append(tuples, tuple)
+				goto next
+			case ',':
+				i++
+				continue
+			case '\'':
+				i++
+				var b strings.Builder
+				for {
+					if i >= len(s) {
+						return nil, errors.New("unterminated string")
+					}
+					c := s[i]
+					if c == '\\' && i+1 < len(s) {
+						b.WriteByte(unescape(s[i+1]))
+						i += 2
+						continue
+					}
+					if c == '\'' {
+						if i+1 < len(s) && s[i+1] == '\'' {
+							b.WriteByte('\'')
+							i += 2
+							continue
+						}
+						i++
+						break
+					}
+					b.WriteByte(c)
+					i++
+				}
+				v := b.String()
+				tuple = append(tuple, &v)
+			default:
+				start := i
+				for i < len(s) && s[i] != ',' && s[i] != ')' {
+					i++
+				}
+				v := strings.TrimSpace(s[start:i])
+				if strings.EqualFold(v, "NULL") {
+					tuple = append(tuple, nil)
+				} else {
+					tuple = append(tuple, &v)
+				}
+			}
+		}
+	next:
+	}
+}
+
+func unescape(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 't':
+		return '\t'
+	case 'r':
+		return '\r'
+	case '0':
+		return 0
+	}
+	return c
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// クーポンは campaigns のキャンペーンで付与する
+// どのクーポンを使うか・いくら割り引くかは selectCoupon と couponDiscount だけで決め、見積もり・ライドの作成・履歴で共有する
+const (
+	campaignSignup  = "signup"
+	campaignInvitee = "invitee"
+	campaignInviter = "inviter"
+)
+
+// campaigns.discount_type
+const (
+	discountTypeFixed   = "FIXED"
+	discountTypePercent = "PERCENT"
+)
+
+// キャンペーンの条件付きのクーポン
+type campaignCoupon struct {
+	Coupon
+	DiscountType  sql.NullString `db:"campaign_discount_type"`
+	MaxDiscount   sql.NullInt64  `db:"campaign_max_discount"`
+	StartsAt      sql.NullTime   `db:"campaign_starts_at"`
+	ExpiresAt     sql.NullTime   `db:"campaign_expires_at"`
+	FirstRideOnly sql.NullBool   `db:"campaign_first_ride_only"`
+	MinFare       sql.NullInt64  `db:"campaign_min_fare"`
+}
+
+const campaignCouponColumns = `coupons.*,
+	campaigns.discount_type AS campaign_discount_type,
+	campaigns.max_discount AS campaign_max_discount,
+	campaigns.starts_at AS campaign_starts_at,
+	campaigns.expires_at AS campaign_expires_at,
+	campaigns.first_ride_only AS campaign_first_ride_only,
+	campaigns.min_fare AS campaign_min_fare`
+
+// priorRides はこのライドより前の (キャンセルされていない) ライドの数、fare は割引前の運賃
+func (c *campaignCoupon) eligible(now time.Time, priorRides int, fare int) bool {
+	if c.StartsAt.Valid && now.Before(c.StartsAt.Time) {
+		return false
+	}
+	if c.ExpiresAt.Valid && !now.Before(c.ExpiresAt.Time) {
+		return false
+	}
+	if c.FirstRideOnly.Valid && c.FirstRideOnly.Bool && priorRides > 0 {
+		return false
+	}
+	return !c.MinFare.Valid || fare >= int(c.MinFare.Int64)
+}
+
+// クーポンはロックせずに選ぶときは DB から、ロックするときはトランザクションから読む
+type couponQueryer interface {
+	executableGet
+	executableSelect
+}
+
+// 割引前の運賃に対する割引額。クーポンの discount は付与したときのキャンペーンの割引額 (定率なら割引率)
+func couponDiscount(c *campaignCoupon, fare int) int {
+	if c == nil {
+		return 0
+	}
+	if c.DiscountType.String != discountTypePercent {
+		return c.Discount
+	}
+	discount := fare * c.Discount / 100
+	if c.MaxDiscount.Valid {
+		discount = min(discount, int(c.MaxDiscount.Int64))
+	}
+	return discount
+}
+
+var (
+	errCouponNotFound      = errors.New("coupon not found")
+	errCouponNotApplicable = errors.New("coupon cannot be used for this ride")
+)
+
+// 使っていないクーポン。selectCoupon が選ぶ順に並べる
+func listCoupons(tx executableSelect, userID string, lock bool) ([]campaignCoupon, error) {
+	query := `SELECT ` + campaignCouponColumns + `
+		FROM coupons LEFT JOIN campaigns ON campaigns.id = coupons.campaign_id
+		WHERE coupons.user_id = ? AND coupons.used_by IS NULL
+		ORDER BY IFNULL(campaigns.priority, 0) DESC, coupons.created_at, coupons.code`
+	if lock {
+		query += ` FOR UPDATE OF coupons`
+	}
+	coupons := []campaignCoupon{}
+	if err := tx.Select(&coupons, query, userID); err != nil {
+		return nil, err
+	}
+	return coupons, nil
+}
+
+// 次のライドで使うクーポン。使えるもののうち優先度が高く、付与された順番が早いものを選ぶ。無ければ nil
+// ライドを作るときは lock で選んだクーポンをロックする
+func selectCoupon(tx couponQueryer, userID string, priorRides int, fare int, lock bool) (*campaignCoupon, error) {
+	coupons, err := listCoupons(tx, userID, lock)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for i := range coupons {
+		if coupons[i].eligible(now, priorRides, fare) {
+			return &coupons[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// code を指定されたらそのクーポンを使う。指定が無ければ selectCoupon で選ぶ
+// 持っていない・使用済みなら errCouponNotFound、条件を満たさなければ errCouponNotApplicable を返す
+func chooseCoupon(tx couponQueryer, userID string, code string, priorRides int, fare int, lock bool) (*campaignCoupon, error) {
+	if code == "" {
+		return selectCoupon(tx, userID, priorRides, fare, lock)
+	}
+	c, err := findCoupon(tx, userID, code, lock)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errCouponNotFound
+		}
+		return nil, err
+	}
+	if !c.eligible(time.Now(), priorRides, fare) {
+		return nil, errCouponNotApplicable
+	}
+	return c, nil
+}
+
+// ライドで使ったクーポン。無ければ nil
+func rideCoupon(tx *sqlx.Tx, rideID string) (*campaignCoupon, error) {
+	c := &campaignCoupon{}
+	if err := tx.Get(
+		c,
+		`SELECT `+campaignCouponColumns+` FROM coupons LEFT JOIN campaigns ON campaigns.id = coupons.campaign_id WHERE coupons.used_by = ?`,
+		rideID,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// ライドごとに使ったクーポン。クーポンを使っていないライドは含まない
+func rideCoupons(tx executableSelect, rideIDs []string) (map[string]*campaignCoupon, error) {
+	coupons := map[string]*campaignCoupon{}
+	if len(rideIDs) == 0 {
+		return coupons, nil
+	}
+	query, args, err := sqlx.In(
+		`SELECT `+campaignCouponColumns+` FROM coupons LEFT JOIN campaigns ON campaigns.id = coupons.campaign_id WHERE coupons.used_by IN (?)`,
+		rideIDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rows := []campaignCoupon{}
+	if err := tx.Select(&rows, query, args...); err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		coupons[*rows[i].UsedBy] = &rows[i]
+	}
+	return coupons, nil
+}
+
+// 使っていないクーポンを code で探す。使われていたら sql.ErrNoRows を返す
+func findCoupon(tx couponQueryer, userID string, code string, lock bool) (*campaignCoupon, error) {
+	query := `SELECT ` + campaignCouponColumns + ` FROM coupons LEFT JOIN campaigns ON campaigns.id = coupons.campaign_id
+		WHERE coupons.user_id = ? AND coupons.code = ? AND coupons.used_by IS NULL`
+	if lock {
+		query += ` FOR UPDATE OF coupons`
+	}
+	c := &campaignCoupon{}
+	if err := tx.Get(c, query, userID, code); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func useCoupon(tx2 *sqlx.Tx, rideID string, c *campaignCoupon) error {
+	_, err := tx2.Exec(
+		"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
+		rideID, c.UserID, c.Code,
+	)
+	return err
+}
+
+// このライドより前の (キャンセルされていない) ライドの数
+func countPriorRides(tx executableGet, userID string, rideID string) (int, error) {
+	var count int
+	if err := tx.Get(&count, `SELECT COUNT(*) FROM rides WHERE user_id = ? AND canceled_at IS NULL AND id <> ?`, userID, rideID); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// キャンペーンのクーポンを付与して、そのコードを返す。期間外や上限に達していたら付与せずに空文字列を返す
+func grantCoupon(tx2 *sqlx.Tx, userID string, campaignID string, invitationCode string) (string, error) {
+	campaign := &Campaign{}
+	if err := tx2.Get(campaign, `SELECT * FROM campaigns WHERE id = ?`, campaignID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+	// 上限のあるキャンペーンだけ、上限を超えないようキャンペーンごとに付与を直列にする
+	// 上限の無いキャンペーン (初回登録など) はロックしないので、同時に登録しても待たない
+	if campaign.GlobalLimit.Valid || campaign.PerUserLimit.Valid {
+		if err := tx2.Get(campaign, `SELECT * FROM campaigns WHERE id = ? FOR UPDATE`, campaignID); err != nil {
+			return "", err
+		}
+	}
+	now := time.Now()
+	if campaign.StartsAt.Valid && now.Before(campaign.StartsAt.Time) {
+		return "", nil
+	}
+	if campaign.ExpiresAt.Valid && !now.Before(campaign.ExpiresAt.Time) {
+		return "", nil
+	}
+	// ロックを取る前のスナップショットではなく、他のトランザクションが付与した最新の行を数える
+	if campaign.GlobalLimit.Valid {
+		var granted int64
+		if err := tx2.Get(&granted, `SELECT COUNT(*) FROM coupons WHERE campaign_id = ? FOR SHARE`, campaign.ID); err != nil {
+			return "", err
+		}
+		if granted >= campaign.GlobalLimit.Int64 {
+			return "", nil
+		}
+	}
+	if campaign.PerUserLimit.Valid {
+		var granted int64
+		if err := tx2.Get(&granted, `SELECT COUNT(*) FROM coupons WHERE campaign_id = ? AND user_id = ? FOR SHARE`, campaign.ID, userID); err != nil {
+			return "", err
+		}
+		if granted >= campaign.PerUserLimit.Int64 {
+			return "", nil
+		}
+	}
+
+	code := strings.NewReplacer(
+		"{invitation_code}", invitationCode,
+		"{timestamp}", strconv.FormatInt(now.UnixMilli(), 10),
+	).Replace(campaign.CodePattern)
+	if _, err := tx2.Exec(
+		"INSERT INTO coupons (user_id, code, discount, campaign_id) VALUES (?, ?, ?, ?)",
+		userID, code, campaign.DiscountValue, campaign.ID,
+	); err != nil {
+		return "", err
+	}
+	return code, nil
+}
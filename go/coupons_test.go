@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestCouponDiscount(t *testing.T) {
+	percent := sql.NullString{String: discountTypePercent, Valid: true}
+	cases := []struct {
+		name   string
+		coupon *campaignCoupon
+		fare   int
+		want   int
+	}{
+		{name: "クーポンなし", coupon: nil, fare: 2000, want: 0},
+		{
+			name:   "キャンペーン前のクーポンは定額",
+			coupon: &campaignCoupon{Coupon: Coupon{Discount: 3000}},
+			fare:   2000,
+			want:   3000,
+		},
+		{
+			name: "定額",
+			coupon: &campaignCoupon{
+				Coupon:       Coupon{Discount: 500},
+				DiscountType: sql.NullString{String: discountTypeFixed, Valid: true},
+			},
+			fare: 2000,
+			want: 500,
+		},
+		{
+			name:   "定率",
+			coupon: &campaignCoupon{Coupon: Coupon{Discount: 10}, DiscountType: percent},
+			fare:   2500,
+			want:   250,
+		},
+		{
+			name:   "定率は切り捨て",
+			coupon: &campaignCoupon{Coupon: Coupon{Discount: 15}, DiscountType: percent},
+			fare:   999,
+			want:   149,
+		},
+		{
+			name: "定率は上限で頭打ち",
+			coupon: &campaignCoupon{
+				Coupon:       Coupon{Discount: 50},
+				DiscountType: percent,
+				MaxDiscount:  sql.NullInt64{Int64: 800, Valid: true},
+			},
+			fare: 3000,
+			want: 800,
+		},
+		{
+			name: "上限に届かなければそのまま",
+			coupon: &campaignCoupon{
+				Coupon:       Coupon{Discount: 50},
+				DiscountType: percent,
+				MaxDiscount:  sql.NullInt64{Int64: 800, Valid: true},
+			},
+			fare: 1000,
+			want: 500,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := couponDiscount(c.coupon, c.fare); got != c.want {
+				t.Errorf("couponDiscount(fare=%d) = %d, want %d", c.fare, got, c.want)
+			}
+		})
+	}
+}
+
+func TestCampaignCouponEligible(t *testing.T) {
+	now := time.Date(2024, 12, 8, 10, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) sql.NullTime { return sql.NullTime{Time: now.Add(d), Valid: true} }
+
+	cases := []struct {
+		name       string
+		coupon     campaignCoupon
+		priorRides int
+		fare       int
+		want       bool
+	}{
+		{name: "条件なし", coupon: campaignCoupon{}, priorRides: 3, fare: 100, want: true},
+		{name: "開始前", coupon: campaignCoupon{StartsAt: at(time.Second)}, want: false},
+		{name: "開始時刻ちょうど", coupon: campaignCoupon{StartsAt: at(0)}, want: true},
+		{name: "期限内", coupon: campaignCoupon{ExpiresAt: at(time.Second)}, want: true},
+		// 期限の時刻ちょうどはもう使えない
+		{name: "期限切れ", coupon: campaignCoupon{ExpiresAt: at(0)}, want: false},
+		{
+			name:       "初回限定で初回",
+			coupon:     campaignCoupon{FirstRideOnly: sql.NullBool{Bool: true, Valid: true}},
+			priorRides: 0,
+			want:       true,
+		},
+		{
+			name:       "初回限定で2回目以降",
+			coupon:     campaignCoupon{FirstRideOnly: sql.NullBool{Bool: true, Valid: true}},
+			priorRides: 1,
+			want:       false,
+		},
+		{
+			name:       "初回限定でないキャンペーン",
+			coupon:     campaignCoupon{FirstRideOnly: sql.NullBool{Bool: false, Valid: true}},
+			priorRides: 5,
+			want:       true,
+		},
+		{
+			name:   "最低運賃ちょうど",
+			coupon: campaignCoupon{MinFare: sql.NullInt64{Int64: 1500, Valid: true}},
+			fare:   1500,
+			want:   true,
+		},
+		{
+			name:   "最低運賃未満",
+			coupon: campaignCoupon{MinFare: sql.NullInt64{Int64: 1500, Valid: true}},
+			fare:   1499,
+			want:   false,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.coupon.eligible(now, c.priorRides, c.fare); got != c.want {
+				t.Errorf("eligible(priorRides=%d, fare=%d) = %v, want %v", c.priorRides, c.fare, got, c.want)
+			}
+		})
+	}
+}
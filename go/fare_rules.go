@@ -0,0 +1,341 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon14/webapp/go/pricing"
+	"github.com/jmoiron/sqlx"
+)
+
+// 他のホストで追加されたルールもこの間隔で読み直す
+const fareRuleRefreshInterval = 5 * time.Second
+
+// 運賃ルールは変更されないので、バージョンごとにキャッシュしておく
+type fareRuleBook struct {
+	mu       sync.Mutex
+	rules    []*pricing.Rule
+	loadedAt time.Time
+}
+
+var fareRules = &fareRuleBook{}
+
+func (b *fareRuleBook) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rules = nil
+	b.loadedAt = time.Time{}
+}
+
+func (b *fareRuleBook) load(force bool) ([]*pricing.Rule, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !force && b.rules != nil && time.Since(b.loadedAt) < fareRuleRefreshInterval {
+		return b.rules, nil
+	}
+	rules, err := loadFareRules(db)
+	if err != nil {
+		return nil, err
+	}
+	b.rules = rules
+	b.loadedAt = time.Now()
+	return rules, nil
+}
+
+// 今見積もるライドに適用するルール
+func (b *fareRuleBook) current() (*pricing.Rule, error) {
+	rules, err := b.load(false)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var current *pricing.Rule
+	for _, rule := range rules {
+		if rule.EffectiveFrom.After(now) {
+			break
+		}
+		current = rule
+	}
+	if current == nil {
+		return &pricing.Default, nil
+	}
+	return current, nil
+}
+
+// ライドを見積もったときのルール
+func (b *fareRuleBook) version(version int) (*pricing.Rule, error) {
+	find := func(rules []*pricing.Rule) *pricing.Rule {
+		for _, rule := range rules {
+			if rule.Version == version {
+				return rule
+			}
+		}
+		return nil
+	}
+	rules, err := b.load(false)
+	if err != nil {
+		return nil, err
+	}
+	if rule := find(rules); rule != nil {
+		return rule, nil
+	}
+	// 他のホストで追加されたばかりのルールかもしれない
+	rules, err = b.load(true)
+	if err != nil {
+		return nil, err
+	}
+	if rule := find(rules); rule != nil {
+		return rule, nil
+	}
+	if version == pricing.Default.Version {
+		return &pricing.Default, nil
+	}
+	return nil, fmt.Errorf("fare rule version %d not found", version)
+}
+
+// ルールを適用順 (effective_from, version) に返す
+func loadFareRules(tx executableSelect) ([]*pricing.Rule, error) {
+	rows := []FareRule{}
+	if err := tx.Select(&rows, `SELECT * FROM fare_rules ORDER BY effective_from, version`); err != nil {
+		return nil, err
+	}
+	tiers := []FareRuleDistanceTier{}
+	if err := tx.Select(&tiers, `SELECT * FROM fare_rule_distance_tiers ORDER BY version, from_distance`); err != nil {
+		return nil, err
+	}
+	multipliers := []FareRuleModelMultiplier{}
+	if err := tx.Select(&multipliers, `SELECT * FROM fare_rule_model_multipliers`); err != nil {
+		return nil, err
+	}
+
+	rules := make([]*pricing.Rule, 0, len(rows))
+	byVersion := make(map[int]*pricing.Rule, len(rows))
+	for _, row := range rows {
+		rule := &pricing.Rule{
+			Version:          row.Version,
+			EffectiveFrom:    row.EffectiveFrom,
+			InitialFare:      row.InitialFare,
+			FarePerDistance:  row.FarePerDistance,
+			MinimumFare:      row.MinimumFare,
+			ModelMultipliers: map[string]int{},
+		}
+		rules = append(rules, rule)
+		byVersion[row.Version] = rule
+	}
+	for _, tier := range tiers {
+		if rule, ok := byVersion[tier.Version]; ok {
+			rule.DistanceTiers = append(rule.DistanceTiers, pricing.DistanceTier{FromDistance: tier.FromDistance, FarePerDistance: tier.FarePerDistance})
+		}
+	}
+	for _, m := range multipliers {
+		if rule, ok := byVersion[m.Version]; ok {
+			rule.ModelMultipliers[m.Model] = m.MultiplierPercent
+		}
+	}
+	return rules, nil
+}
+
+// ライドの運賃を計算するルールと椅子モデル。椅子が決まる前はモデルを空で返す
+// 見積もりIDで配車したライドは、見積もりと同じくモデルの倍率を掛けないので空で返す
+func rideFareRule(ride *Ride) (*pricing.Rule, string, error) {
+	rule, err := fareRules.version(ride.FareRuleVersion)
+	if err != nil {
+		return nil, "", err
+	}
+	if !ride.ChairID.Valid || ride.QuotedFare.Valid {
+		return rule, "", nil
+	}
+	if v, ok := chairMinimalCache.Load(ride.ChairID.String); ok {
+		return rule, v.(*Chair).Model, nil
+	}
+	var model string
+	if err := db.Get(&model, `SELECT model FROM chairs WHERE id = ?`, ride.ChairID.String); err != nil {
+		return nil, "", err
+	}
+	return rule, model, nil
+}
+
+type fareRuleDistanceTier struct {
+	FromDistance    int `json:"from_distance"`
+	FarePerDistance int `json:"fare_per_distance"`
+}
+
+type fareRuleResponse struct {
+	Version         int                    `json:"version"`
+	EffectiveFrom   int64                  `json:"effective_from"`
+	InitialFare     int                    `json:"initial_fare"`
+	FarePerDistance int                    `json:"fare_per_distance"`
+	MinimumFare     int                    `json:"minimum_fare"`
+	DistanceTiers   []fareRuleDistanceTier `json:"distance_tiers"`
+	// 椅子モデルごとの倍率 (%)
+	ModelMultipliers map[string]int `json:"model_multipliers"`
+}
+
+func newFareRuleResponse(rule *pricing.Rule) fareRuleResponse {
+	res := fareRuleResponse{
+		Version:          rule.Version,
+		EffectiveFrom:    rule.EffectiveFrom.UnixMilli(),
+		InitialFare:      rule.InitialFare,
+		FarePerDistance:  rule.FarePerDistance,
+		MinimumFare:      rule.MinimumFare,
+		DistanceTiers:    []fareRuleDistanceTier{},
+		ModelMultipliers: map[string]int{},
+	}
+	for _, tier := range rule.DistanceTiers {
+		res.DistanceTiers = append(res.DistanceTiers, fareRuleDistanceTier{FromDistance: tier.FromDistance, FarePerDistance: tier.FarePerDistance})
+	}
+	for model, m := range rule.ModelMultipliers {
+		res.ModelMultipliers[model] = m
+	}
+	return res
+}
+
+type internalGetFareRulesResponse struct {
+	// 今見積もるライドに適用するバージョン
+	CurrentVersion int                `json:"current_version"`
+	Rules          []fareRuleResponse `json:"rules"`
+}
+
+func internalGetFareRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := fareRules.load(true)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	current, err := fareRules.current()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res := internalGetFareRulesResponse{CurrentVersion: current.Version, Rules: []fareRuleResponse{}}
+	for _, rule := range rules {
+		res.Rules = append(res.Rules, newFareRuleResponse(rule))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type internalPostFareRuleRequest struct {
+	// 省略したらすぐに適用する
+	EffectiveFrom    *int64                 `json:"effective_from"`
+	InitialFare      int                    `json:"initial_fare"`
+	FarePerDistance  int                    `json:"fare_per_distance"`
+	MinimumFare      int                    `json:"minimum_fare"`
+	DistanceTiers    []fareRuleDistanceTier `json:"distance_tiers"`
+	ModelMultipliers map[string]int         `json:"model_multipliers"`
+}
+
+// 新しいバージョンの運賃ルールを追加する。既存のバージョンは変更できない
+func internalPostFareRule(w http.ResponseWriter, r *http.Request) {
+	req := &internalPostFareRuleRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	effectiveFrom := time.Now()
+	if req.EffectiveFrom != nil {
+		effectiveFrom = time.UnixMilli(*req.EffectiveFrom)
+		// 見積もり済みのライドはバージョンで計算するので影響しないが、過去の見積もりと食い違うので遡らせない
+		if effectiveFrom.Before(time.Now()) {
+			writeError(w, http.StatusBadRequest, errors.New("effective_from must not be in the past"))
+			return
+		}
+	}
+	if req.InitialFare < 0 || req.FarePerDistance < 0 || req.MinimumFare < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("fares must not be negative"))
+		return
+	}
+	slices.SortFunc(req.DistanceTiers, func(a, b fareRuleDistanceTier) int {
+		return cmp.Compare(a.FromDistance, b.FromDistance)
+	})
+	for i, tier := range req.DistanceTiers {
+		if tier.FromDistance <= 0 || tier.FarePerDistance < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("distance tiers must start after 0 and have a non-negative fare"))
+			return
+		}
+		if i > 0 && req.DistanceTiers[i-1].FromDistance == tier.FromDistance {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("duplicate distance tier: %d", tier.FromDistance))
+			return
+		}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	for model, m := range req.ModelMultipliers {
+		if m <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("multiplier for %s must be positive", model))
+			return
+		}
+		if err := tx.Get(new(string), `SELECT name FROM chair_models WHERE name = ?`, model); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("unknown chair model: %s", model))
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	version, err := insertFareRule(tx, effectiveFrom, req)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err := fareRules.load(true); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	rule, err := fareRules.version(version)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newFareRuleResponse(rule))
+}
+
+func insertFareRule(tx *sqlx.Tx, effectiveFrom time.Time, req *internalPostFareRuleRequest) (int, error) {
+	result, err := tx.Exec(
+		`INSERT INTO fare_rules (effective_from, initial_fare, fare_per_distance, minimum_fare) VALUES (?, ?, ?, ?)`,
+		effectiveFrom, req.InitialFare, req.FarePerDistance, req.MinimumFare,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	version := int(id)
+	for _, tier := range req.DistanceTiers {
+		if _, err := tx.Exec(
+			`INSERT INTO fare_rule_distance_tiers (version, from_distance, fare_per_distance) VALUES (?, ?, ?)`,
+			version, tier.FromDistance, tier.FarePerDistance,
+		); err != nil {
+			return 0, err
+		}
+	}
+	for model, m := range req.ModelMultipliers {
+		if _, err := tx.Exec(
+			`INSERT INTO fare_rule_model_multipliers (version, model, multiplier_percent) VALUES (?, ?, ?)`,
+			version, model, m,
+		); err != nil {
+			return 0, err
+		}
+	}
+	return version, nil
+}
@@ -5,13 +5,13 @@ go 1.23
 require (
 	github.com/go-chi/chi/v5 v5.1.0
 	github.com/go-sql-driver/mysql v1.8.1
+	github.com/goccy/go-json v0.10.3
 	github.com/jmoiron/sqlx v1.4.0
 	github.com/oklog/ulid/v2 v2.1.0
+	github.com/samber/lo v1.47.0
 )
 
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
-	github.com/goccy/go-json v0.10.3 // indirect
-	github.com/samber/lo v1.47.0 // indirect
 	golang.org/x/text v0.16.0 // indirect
 )
@@ -1,28 +1,19 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"log/slog"
 	"math"
 	"net/http"
-	"sort"
 	"sync"
 	"time"
 
+	"github.com/isucon/isucon14/webapp/go/matcher"
+	"github.com/jmoiron/sqlx"
 	"github.com/samber/lo"
 )
 
-type matching struct {
-	Ride  *Ride
-	Chair *Chair
-	Score float64
-	PD    int
-	DD    int
-	Age   float64
-	Speed int
-}
-
 var chairsInRide = sync.Map{}
 var nearByChairsCache = sync.Map{}
 
@@ -49,137 +40,216 @@ func internalChairsCache(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// このAPIをインスタンス内から一定間隔で叩かせることで、椅子とライドをマッチングさせる
+// マッチング1回分の実行結果
+type matchingResult struct {
+	Leader     bool    `json:"leader"`
+	Strategy   string  `json:"strategy"`
+	Rides      int     `json:"rides"`
+	Chairs     int     `json:"chairs"`
+	FreeChairs int     `json:"free_chairs"`
+	Matched    int     `json:"matched"`
+	Remaining  int     `json:"remaining"`
+	MaxAge     float64 `json:"max_age"`
+	// 割り当てた椅子から配車位置までの距離の合計
+	PickupDistance int   `json:"pickup_distance"`
+	ElapsedMs      int64 `json:"elapsed_ms"`
+}
+
+// 手動でマッチングを1回実行し、その結果を返す
+// 通常は main() で起動したマッチングループが ISUCON_MATCHING_INTERVAL 間隔で実行している
+// ?strategy= で今回だけ使うマッチング戦略を指定できる
 func internalGetMatching(w http.ResponseWriter, r *http.Request) {
-	rides := []*Ride{}
-	if err := db.Select(&rides, `SELECT * FROM rides WHERE chair_id IS NULL ORDER BY id`); err != nil {
-		if errors.Is(err, sql.ErrNoRows) || len(rides) == 0 {
-			slog.Info("no rides for waiting", "err", err)
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
+	strategy := r.URL.Query().Get("strategy")
+	if strategy == "" {
+		strategy = matchingScheduler.strategy
+	}
+	m, err := matcher.New(strategy)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	result, err := matchingScheduler.RunOnce(r.Context(), m, strategy)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// 椅子とライドのマッチングを1回行う
+// 複数ホストで同時に実行されないよう、呼び出し側でリーダーであることを確認しておくこと
+// ctx はロックを取るところからマッチングの書き込みまでをまとめて打ち切る
+func runMatching(ctx context.Context, m matcher.Matcher, strategy string) (*matchingResult, error) {
+	start := time.Now()
+	result := &matchingResult{Leader: true, Strategy: strategy}
+	defer func() {
+		result.ElapsedMs = time.Since(start).Milliseconds()
+	}()
+
+	rides := []*Ride{}
+	if err := db.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE chair_id IS NULL AND canceled_at IS NULL ORDER BY id`); err != nil {
+		return nil, err
+	}
+	result.Rides = len(rides)
+	if len(rides) == 0 {
+		slog.Debug("no rides for waiting")
+		refreshSurge(nil, nil)
+		return result, nil
+	}
 
 	chairs := make([]struct {
 		Chair
 		Speed int `db:"speed"`
 	}, 0, 1000)
-	if err := db.Select(&chairs,
+	if err := db.SelectContext(ctx, &chairs,
 		`SELECT *, speed FROM chairs JOIN chair_models ON (chairs.model=chair_models.name) WHERE is_active = TRUE AND latitude IS NOT NULL`,
 	); err != nil {
-		if errors.Is(err, sql.ErrNoRows) || len(chairs) == 0 {
-			slog.Info("no active chairs", "err", err)
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return nil, err
+	}
+	result.Chairs = len(chairs)
+	if len(chairs) == 0 {
+		slog.Info("no active chairs")
+		refreshSurge(rides, nil)
+		result.Remaining = len(rides)
+		return result, nil
 	}
 
-	//chairとrideのマッチングをするためにスコアを計算
-	matchings := []matching{}
-	freeChairsCount := 0
-	for _, chair := range chairs {
-		if _, ok := chairsInRide.Load(chair.ID); ok {
+	busy, err := busyChairIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	freeChairs := make([]*matcher.Chair, 0, len(chairs))
+	chairByID := make(map[string]*Chair, len(chairs))
+	for i := range chairs {
+		chair := &chairs[i]
+		if busy[chair.ID] {
 			// ride中の椅子はスキップ
 			continue
 		}
-		freeChairsCount++
-		for _, ride := range rides {
-			pickupDistance := calculateDistance(*chair.Latitude, *chair.Longitude, ride.PickupLatitude, ride.PickupLongitude)
-			destinationDistance := calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-			age := time.Since(ride.CreatedAt).Seconds()
-			var score float64
-			// pickupDistanceは少ないほどよい
-			if pickupDistance == 0 {
-				score += 250
-			} else {
-				score += 250 / float64(pickupDistance)
-			}
-			//destinationDistanceは多いほどよい
-			// score += float64(destinationDistance) / 10
-
-			// ageが古いやつから優先
-			score += 10 * age
-
-			if age > 20 {
-				score += 10000 // 最優先
-			}
-
-			matchings = append(matchings, matching{
-				Ride: ride, Chair: &chair.Chair, Score: score,
-				PD: pickupDistance, DD: destinationDistance, Age: age,
-				Speed: chair.Speed,
-			})
-		}
+		freeChairs = append(freeChairs, &matcher.Chair{
+			ID:        chair.ID,
+			Latitude:  *chair.Latitude,
+			Longitude: *chair.Longitude,
+			Speed:     chair.Speed,
+		})
+		chairByID[chair.ID] = &chair.Chair
 	}
-	slog.Info("count", "chairs", len(chairs), "free", freeChairsCount, "rides", len(rides))
-
-	// スコアが高い順に並び替え
-	sort.SliceStable(matchings, func(i, j int) bool {
-		return matchings[i].Score > matchings[j].Score
-	})
-	matchedRides := map[string]bool{}
-	matchedChairs := map[string]bool{}
-	comletedMatchings := []matching{}
-
-	for _, m := range matchings {
-		if matchedRides[m.Ride.ID] || matchedChairs[m.Chair.ID] {
-			continue
-		}
-		if m.PD > 50 && m.Score < 10000 {
-			// 遠すぎる
-			continue
-		}
-		/*
-			if m.Score > 10000 && m.Speed >= 5 {
-				// どうせ待たせてるので速いやつを使うのはもったいない
-				continue
-			}
-		*/
-		matchedRides[m.Ride.ID] = true
-		matchedChairs[m.Chair.ID] = true
-		comletedMatchings = append(comletedMatchings, m)
+	waitingRides := make([]*matcher.Ride, 0, len(rides))
+	rideByID := make(map[string]*Ride, len(rides))
+	for _, ride := range rides {
+		waitingRides = append(waitingRides, &matcher.Ride{
+			ID:                   ride.ID,
+			PickupLatitude:       ride.PickupLatitude,
+			PickupLongitude:      ride.PickupLongitude,
+			DestinationLatitude:  ride.DestinationLatitude,
+			DestinationLongitude: ride.DestinationLongitude,
+			CreatedAt:            ride.CreatedAt,
+		})
+		rideByID[ride.ID] = ride
 	}
+	result.FreeChairs = len(freeChairs)
+	slog.Info("count", "chairs", len(chairs), "free", len(freeChairs), "rides", len(rides))
+	refreshSurge(rides, freeChairs)
+
+	comletedMatchings := m.Match(start, waitingRides, freeChairs)
 	if len(comletedMatchings) == 0 {
-		w.WriteHeader(http.StatusNoContent)
-		return
+		result.Remaining = len(rides)
+		return result, nil
 	}
 
 	matchedCount := 0
 	var maxAge float64
 	for _, chunk := range lo.Chunk(comletedMatchings, 40) {
 		notifies := map[string]notify{}
-		tx, err := db.Beginx()
+		tx, err := db.BeginTxx(ctx, nil)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			return nil, err
 		}
-		for _, m := range chunk {
-			maxAge = math.Max(maxAge, m.Age)
-			slog.Debug("matched", "score", m.Score, "pd", m.PD, "dd", m.DD, "age", m.Age, "speed", m.Speed)
-			rideCache.Delete(m.Ride.ID)
-			if _, err := tx.Exec("UPDATE rides SET chair_id = ? WHERE id = ?", m.Chair.ID, m.Ride.ID); err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
+		for _, a := range chunk {
+			maxAge = math.Max(maxAge, a.Age)
+			result.PickupDistance += a.PD
+			slog.Debug("matched", "score", a.Score, "pd", a.PD, "dd", a.DD, "age", a.Age, "speed", a.Chair.Speed)
+			rideCache.Delete(a.Ride.ID)
+			res, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = ? WHERE id = ? AND canceled_at IS NULL", a.Chair.ID, a.Ride.ID)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			if n, err := res.RowsAffected(); err != nil {
+				tx.Rollback()
+				return nil, err
+			} else if n == 0 {
+				// マッチング中にキャンセルされた
+				continue
 			}
-			notifies[m.Chair.ID] = notify{Ride: m.Ride, Status: "MATCHING"}
-			m.Ride.ChairID = sql.NullString{String: m.Chair.ID, Valid: true}
-			matchedCount++
+			ride := rideByID[a.Ride.ID]
+			ride.ChairID = sql.NullString{String: a.Chair.ID, Valid: true}
+			notifies[a.Chair.ID] = notify{Ride: ride, Status: "MATCHING"}
 		}
-		tx.Commit()
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		matchedCount += len(notifies)
 		for chairID, ns := range notifies {
-			sendNotificationSSE(chairID, ns.Ride, ns.Status)
-			sendNotificationSSEApp(ns.Ride.UserID, ns.Ride, ns.Status)
+			rideStateMachine.Notify(ns.Ride, ns.Status)
 			chairsInRide.Store(chairID, ns.Ride)
 		}
 		//if matchedCount >= 150 {
 		//	break
 		//}
 	}
+	result.Matched = matchedCount
+	result.Remaining = len(rides) - matchedCount
+	result.MaxAge = maxAge
 	avgAge := maxAge / float64(len(comletedMatchings))
 	slog.Info("count", "matched", matchedCount, "remaining", len(rides)-matchedCount, "max_age", maxAge, "avg_age", avgAge)
-	w.WriteHeader(http.StatusNoContent)
+	return result, nil
+}
+
+// ライド中の椅子。椅子が割り当てられていて、ステータスが終わっていないライドがある椅子を返す
+// 椅子が空いたことはそのライドを扱ったホストしか知らないので、プロセス内のキャッシュではなく DB から求める
+func busyChairIDs(ctx context.Context) (map[string]bool, error) {
+	rides := []struct {
+		ID      string `db:"id"`
+		ChairID string `db:"chair_id"`
+	}{}
+	if err := db.SelectContext(ctx, &rides, `SELECT id, chair_id FROM rides WHERE chair_id IS NOT NULL AND evaluation IS NULL AND canceled_at IS NULL`); err != nil {
+		return nil, err
+	}
+	busy := make(map[string]bool, len(rides))
+	if len(rides) == 0 {
+		return busy, nil
+	}
+	rideIDs := make([]string, 0, len(rides))
+	for _, ride := range rides {
+		rideIDs = append(rideIDs, ride.ID)
+	}
+	query, args, err := sqlx.In(
+		`SELECT ride_id FROM ride_status WHERE ride_id IN (?) AND status IN (?)`,
+		rideIDs, rideStateMachine.TerminalStatuses(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	finished := []string{}
+	if err := db2.SelectContext(ctx, &finished, query, args...); err != nil {
+		return nil, err
+	}
+	finishedByID := make(map[string]bool, len(finished))
+	for _, id := range finished {
+		finishedByID[id] = true
+	}
+	for _, ride := range rides {
+		if !finishedByID[ride.ID] {
+			busy[ride.ChairID] = true
+		}
+	}
+	return busy, nil
+}
+
+// マッチングする前の需給でサージの倍率を更新する。失敗してもマッチングは続ける
+func refreshSurge(rides []*Ride, freeChairs []*matcher.Chair) {
+	if err := updateSurge(rides, freeChairs); err != nil {
+		slog.Error("failed to update surge", "err", err)
+	}
 }
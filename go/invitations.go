@@ -0,0 +1,50 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 招待コードは invitations の台帳で数え、1つのコードで招待できるのは invitationLimit 人まで
+// 台帳は users と同じプライマリーに置き、招待した人の行をロックしてから数えるので、同時に登録されても上限を超えない
+const invitationLimit = 3
+
+var errInvitationUnavailable = errors.New("この招待コードは使用できません。")
+
+// 招待コードを使って登録したユーザーと招待した人にクーポンを付与し、台帳に記録する
+// 招待コードが無い、または上限に達していたら errInvitationUnavailable を返す
+func redeemInvitation(tx *sqlx.Tx, tx2 *sqlx.Tx, inviteeID string, invitationCode string) error {
+	inviter := &User{}
+	if err := tx.Get(inviter, "SELECT * FROM users WHERE invitation_code = ? FOR UPDATE", invitationCode); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errInvitationUnavailable
+		}
+		return err
+	}
+	// 先に登録した人のコミットが見えるようロックして数える
+	var invited int
+	if err := tx.Get(&invited, "SELECT COUNT(*) FROM invitations WHERE inviter_id = ? FOR UPDATE", inviter.ID); err != nil {
+		return err
+	}
+	if invited >= invitationLimit {
+		return errInvitationUnavailable
+	}
+
+	// 招待クーポン付与
+	if _, err := grantCoupon(tx2, inviteeID, campaignInvitee, invitationCode); err != nil {
+		return err
+	}
+	// 招待した人にもRewardを付与
+	rewardCode, err := grantCoupon(tx2, inviter.ID, campaignInviter, invitationCode)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO invitations (inviter_id, invitee_id, invitation_code, reward_coupon_code) VALUES (?, ?, ?, ?)",
+		inviter.ID, inviteeID, invitationCode, sql.NullString{String: rewardCode, Valid: rewardCode != ""},
+	)
+	return err
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"context"
 	crand "crypto/rand"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -26,8 +30,37 @@ func main() {
 	for i := 0; i < updateChairLocationsWorkers; i++ {
 		go chairLocationsUpdateWorker(i)
 	}
-	slog.Info("Listening on :8080")
-	http.ListenAndServe(":8080", mux)
+	startMatchingLoop()
+	startPaymentWorkers()
+	startNotificationPruner()
+	// 同じホストで複数プロセスを立てるときは ISUCON_APP_PORT でずらす
+	appPort := os.Getenv("ISUCON_APP_PORT")
+	if appPort == "" {
+		appPort = "8080"
+	}
+	srv := &http.Server{Addr: ":" + appPort, Handler: mux}
+	srv.RegisterOnShutdown(closeNotificationStreams)
+
+	// SIGTERM/SIGINT を受けたら、SSEの接続を閉じてから処理中のリクエストを待って終了する
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+		slog.Info("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Error("failed to shutdown", "err", err)
+		}
+	}()
+
+	slog.Info("Listening on :" + appPort)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		panic(err)
+	}
+	<-shutdownDone
 }
 
 func setup() http.Handler {
@@ -80,6 +113,14 @@ func setup() http.Handler {
 	db2 = _db2
 	db2.SetMaxOpenConns(1000)
 
+	bus, err := newNotificationBus(os.Getenv("ISUCON_NOTIFICATION_BUS"), db2)
+	if err != nil {
+		panic(err)
+	}
+	notificationBus = bus
+	surgeSettings = loadSurgeConfig()
+	quoteSecret = loadQuoteSecret()
+
 	mux := chi.NewRouter()
 	//mux.Use(middleware.Logger)
 	mux.Use(middleware.Recoverer)
@@ -91,12 +132,18 @@ func setup() http.Handler {
 
 		authedMux := mux.With(appAuthMiddleware)
 		authedMux.HandleFunc("POST /api/app/payment-methods", appPostPaymentMethods)
+		authedMux.HandleFunc("GET /api/app/payment-methods", appGetPaymentMethods)
+		authedMux.HandleFunc("DELETE /api/app/payment-methods/{payment_method_id}", appDeletePaymentMethod)
+		authedMux.HandleFunc("POST /api/app/payment-methods/{payment_method_id}/default", appPostPaymentMethodDefault)
+		authedMux.HandleFunc("GET /api/app/coupons", appGetCoupons)
+		authedMux.HandleFunc("GET /api/app/invitations", appGetInvitations)
 		authedMux.HandleFunc("GET /api/app/rides", appGetRides)
 		authedMux.HandleFunc("POST /api/app/rides", appPostRides)
 		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", appPostRidesEstimatedFare)
 		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", appPostRideEvaluatation)
-		//authedMux.HandleFunc("GET /api/app/notification", appGetNotification)//SSE)
-		authedMux.HandleFunc("GET /api/app/notification", appGetNotificationSSE)
+		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/cancel", appPostRideCancel)
+		authedMux.HandleFunc("GET /api/app/rides/{ride_id}/timeline", appGetRideTimeline)
+		authedMux.HandleFunc("GET /api/app/notification", appGetNotification)
 		authedMux.HandleFunc("GET /api/app/nearby-chairs", appGetNearbyChairs)
 	}
 
@@ -116,15 +163,20 @@ func setup() http.Handler {
 		authedMux := mux.With(chairAuthMiddleware)
 		authedMux.HandleFunc("POST /api/chair/activity", chairPostActivity)
 		authedMux.HandleFunc("POST /api/chair/coordinate", chairPostCoordinate)
-		//authedMux.HandleFunc("GET /api/chair/notification", chairGetNotification)//SSE)
-		authedMux.HandleFunc("GET /api/chair/notification", chairGetNotificationSSE)
+		authedMux.HandleFunc("GET /api/chair/notification", chairGetNotification)
 		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/status", chairPostRideStatus)
+		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/cancel", chairPostRideCancel)
 	}
 
 	// internal handlers
 	{
 		mux.HandleFunc("GET /api/internal/matching", internalGetMatching)
 		mux.HandleFunc("GET /api/internal/chairs-cache", internalChairsCache)
+
+		operatorMux := mux.With(operatorAuthMiddleware)
+		operatorMux.HandleFunc("POST /api/internal/rides/{ride_id}/refunds", internalPostRideRefund)
+		operatorMux.HandleFunc("GET /api/internal/fare-rules", internalGetFareRules)
+		operatorMux.HandleFunc("POST /api/internal/fare-rules", internalPostFareRule)
 	}
 
 	return mux
@@ -146,6 +198,10 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 初期化中にマッチングが走らないようにする
+	matchingScheduler.mu.Lock()
+	defer matchingScheduler.mu.Unlock()
+
 	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to initialize: %s: %w", string(out), err))
 		return
@@ -159,13 +215,13 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 	urlCache = sync.Map{}
 	sessionCache = sync.Map{}
 	ownerSessionCache = sync.Map{}
-	chairChannels = sync.Map{}
 	usersMinimalCache = sync.Map{}
 	chairsInRide = sync.Map{}
-	appChannels = sync.Map{}
-	chairChannels = sync.Map{}
+	notificationCursors = sync.Map{}
 	chairMinimalCache = sync.Map{}
 	rideCache = sync.Map{}
+	fareRules.reset()
+	surge.reset()
 
 	time.Sleep(time.Second)
 
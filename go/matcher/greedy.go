@@ -0,0 +1,63 @@
+package matcher
+
+import (
+	"sort"
+	"time"
+)
+
+// Greedy はスコアの高い組み合わせから順に割り当てる
+// スコアは配車位置までの距離が近いほど、待ち時間が長いほど高い
+type Greedy struct{}
+
+func (g *Greedy) Match(now time.Time, rides []*Ride, chairs []*Chair) []Assignment {
+	//chairとrideのマッチングをするためにスコアを計算
+	candidates := make([]Assignment, 0, len(rides)*len(chairs))
+	for _, chair := range chairs {
+		for _, ride := range rides {
+			a := newAssignment(now, ride, chair, 0)
+			// pickupDistanceは少ないほどよい
+			if a.PD == 0 {
+				a.Score += 250
+			} else {
+				a.Score += 250 / float64(a.PD)
+			}
+			//destinationDistanceは多いほどよい
+			// a.Score += float64(a.DD) / 10
+
+			// ageが古いやつから優先
+			a.Score += 10 * a.Age
+
+			if a.Age > 20 {
+				a.Score += 10000 // 最優先
+			}
+			candidates = append(candidates, a)
+		}
+	}
+
+	// スコアが高い順に並び替え
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+	matchedRides := map[string]bool{}
+	matchedChairs := map[string]bool{}
+	assignments := []Assignment{}
+	for _, a := range candidates {
+		if matchedRides[a.Ride.ID] || matchedChairs[a.Chair.ID] {
+			continue
+		}
+		if a.PD > 50 && a.Score < 10000 {
+			// 遠すぎる
+			continue
+		}
+		/*
+			if a.Score > 10000 && a.Chair.Speed >= 5 {
+				// どうせ待たせてるので速いやつを使うのはもったいない
+				continue
+			}
+		*/
+		matchedRides[a.Ride.ID] = true
+		matchedChairs[a.Chair.ID] = true
+		assignments = append(assignments, a)
+	}
+	return assignments
+}
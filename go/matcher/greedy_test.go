@@ -0,0 +1,76 @@
+package matcher
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestGreedyMatch(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		rides  []*Ride
+		chairs []*Chair
+		// ライドIDごとの割り当てる椅子
+		want map[string]string
+	}{
+		{
+			name:   "no chairs",
+			rides:  []*Ride{{ID: "r1", CreatedAt: now}},
+			chairs: nil,
+			want:   map[string]string{},
+		},
+		{
+			name:  "nearest chair",
+			rides: []*Ride{{ID: "r1", PickupLatitude: 10, CreatedAt: now}},
+			chairs: []*Chair{
+				{ID: "c1", Latitude: 0, Speed: 1},
+				{ID: "c2", Latitude: 8, Speed: 1},
+			},
+			want: map[string]string{"r1": "c2"},
+		},
+		{
+			name: "each chair is assigned once",
+			rides: []*Ride{
+				{ID: "r1", PickupLatitude: 1, CreatedAt: now},
+				{ID: "r2", PickupLatitude: 2, CreatedAt: now},
+			},
+			chairs: []*Chair{{ID: "c1", Latitude: 0, Speed: 1}},
+			want:   map[string]string{"r1": "c1"},
+		},
+		{
+			name:   "too far",
+			rides:  []*Ride{{ID: "r1", PickupLatitude: 51, CreatedAt: now}},
+			chairs: []*Chair{{ID: "c1", Latitude: 0, Speed: 1}},
+			want:   map[string]string{},
+		},
+		{
+			name:   "too far but waiting long",
+			rides:  []*Ride{{ID: "r1", PickupLatitude: 51, CreatedAt: now.Add(-21 * time.Second)}},
+			chairs: []*Chair{{ID: "c1", Latitude: 0, Speed: 1}},
+			want:   map[string]string{"r1": "c1"},
+		},
+		{
+			// 待ち時間の長いライドを先に割り当てる
+			name: "older ride first",
+			rides: []*Ride{
+				{ID: "r1", PickupLatitude: 5, CreatedAt: now},
+				{ID: "r2", PickupLatitude: 10, CreatedAt: now.Add(-10 * time.Second)},
+			},
+			chairs: []*Chair{{ID: "c1", Latitude: 0, Speed: 1}},
+			want:   map[string]string{"r2": "c1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[string]string{}
+			for _, a := range (&Greedy{}).Match(now, tt.rides, tt.chairs) {
+				got[a.Ride.ID] = a.Chair.ID
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package matcher
+
+import (
+	"math"
+	"time"
+)
+
+// Hungarian は割り当てたペアの配車位置までの所要時間(距離/速度)の合計が最小になるように割り当てる
+// ライドと椅子の少ない方の数だけ割り当てる
+type Hungarian struct{}
+
+func (h *Hungarian) Match(now time.Time, rides []*Ride, chairs []*Chair) []Assignment {
+	if len(rides) == 0 || len(chairs) == 0 {
+		return []Assignment{}
+	}
+
+	// 行の数 <= 列の数 になるようにする
+	transposed := len(rides) > len(chairs)
+	n, m := len(rides), len(chairs)
+	if transposed {
+		n, m = m, n
+	}
+	cost := func(i, j int) int64 {
+		if transposed {
+			return int64(PickupTime(chairs[i], rides[j]))
+		}
+		return int64(PickupTime(chairs[j], rides[i]))
+	}
+
+	rowOf := solveAssignment(n, m, cost)
+
+	assignments := make([]Assignment, 0, n)
+	for j := 1; j <= m; j++ {
+		if rowOf[j] == 0 {
+			continue
+		}
+		ri, ci := rowOf[j]-1, j-1
+		if transposed {
+			ri, ci = ci, ri
+		}
+		t := PickupTime(chairs[ci], rides[ri])
+		assignments = append(assignments, newAssignment(now, rides[ri], chairs[ci], -float64(t)))
+	}
+	return assignments
+}
+
+// solveAssignment はn行m列(n <= m)のコスト行列に対する最小コスト割り当てを求める
+// 戻り値は列j(1-indexed)に割り当てられた行(1-indexed, 未割り当てなら0)
+func solveAssignment(n, m int, cost func(i, j int) int64) []int {
+	const inf = math.MaxInt64 / 4
+	u := make([]int64, n+1)
+	v := make([]int64, m+1)
+	p := make([]int, m+1)
+	way := make([]int, m+1)
+	minv := make([]int64, m+1)
+	used := make([]bool, m+1)
+
+	for i := 1; i <= n; i++ {
+		p[0] = i
+		j0 := 0
+		for j := range minv {
+			minv[j] = inf
+			used[j] = false
+		}
+		for {
+			used[j0] = true
+			i0 := p[j0]
+			delta := int64(inf)
+			j1 := 0
+			for j := 1; j <= m; j++ {
+				if used[j] {
+					continue
+				}
+				cur := cost(i0-1, j-1) - u[i0] - v[j]
+				if cur < minv[j] {
+					minv[j] = cur
+					way[j] = j0
+				}
+				if minv[j] < delta {
+					delta = minv[j]
+					j1 = j
+				}
+			}
+			for j := 0; j <= m; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+	return p
+}
@@ -0,0 +1,211 @@
+package matcher
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+func matrixCost(c [][]int64) func(i, j int) int64 {
+	return func(i, j int) int64 { return c[i][j] }
+}
+
+// 列ごとの割り当て (1-indexed) から合計コストを求める
+func assignmentCost(t *testing.T, c [][]int64, rowOf []int) int64 {
+	t.Helper()
+	var total int64
+	seen := map[int]bool{}
+	for j := 1; j < len(rowOf); j++ {
+		i := rowOf[j]
+		if i == 0 {
+			continue
+		}
+		if seen[i] {
+			t.Fatalf("row %d is assigned twice: %v", i, rowOf)
+		}
+		seen[i] = true
+		total += c[i-1][j-1]
+	}
+	if len(seen) != len(c) {
+		t.Fatalf("assigned %d rows, want %d: %v", len(seen), len(c), rowOf)
+	}
+	return total
+}
+
+// 全通りを試した最小コスト
+func bruteForceCost(c [][]int64) int64 {
+	m := len(c[0])
+	used := make([]bool, m)
+	best := int64(-1)
+	var rec func(i int, sum int64)
+	rec = func(i int, sum int64) {
+		if i == len(c) {
+			if best < 0 || sum < best {
+				best = sum
+			}
+			return
+		}
+		for j := 0; j < m; j++ {
+			if used[j] {
+				continue
+			}
+			used[j] = true
+			rec(i+1, sum+c[i][j])
+			used[j] = false
+		}
+	}
+	rec(0, 0)
+	return best
+}
+
+// 行ごとに空いている列で一番安いものを取る
+func greedyCost(c [][]int64) int64 {
+	used := make([]bool, len(c[0]))
+	var total int64
+	for i := range c {
+		best := -1
+		for j := range c[i] {
+			if !used[j] && (best < 0 || c[i][j] < c[i][best]) {
+				best = j
+			}
+		}
+		used[best] = true
+		total += c[i][best]
+	}
+	return total
+}
+
+func TestSolveAssignment(t *testing.T) {
+	tests := []struct {
+		name string
+		cost [][]int64
+		want int64
+		// 行ごとの貪欲法のコスト。最適解より良くならないことも確かめる
+		greedy int64
+	}{
+		{
+			name: "1x1",
+			cost: [][]int64{{7}},
+			want: 7,
+		},
+		{
+			name:   "square",
+			cost:   [][]int64{{4, 1, 3}, {2, 0, 5}, {3, 2, 2}},
+			want:   5,
+			greedy: 1 + 2 + 2,
+		},
+		{
+			name:   "greedy is not optimal",
+			cost:   [][]int64{{1, 2}, {1, 100}},
+			want:   3,
+			greedy: 101,
+		},
+		{
+			name: "rectangular 2x4",
+			cost: [][]int64{{9, 8, 1, 9}, {9, 9, 2, 3}},
+			want: 4,
+		},
+		{
+			name: "rectangular 1x3",
+			cost: [][]int64{{5, 3, 4}},
+			want: 3,
+		},
+		{
+			name: "ties",
+			cost: [][]int64{{1, 1}, {1, 1}},
+			want: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rowOf := solveAssignment(len(tt.cost), len(tt.cost[0]), matrixCost(tt.cost))
+			if got := assignmentCost(t, tt.cost, rowOf); got != tt.want {
+				t.Errorf("cost = %d, want %d (assignment %v)", got, tt.want, rowOf)
+			}
+			if tt.greedy != 0 {
+				if g := greedyCost(tt.cost); g != tt.greedy {
+					t.Errorf("greedy cost = %d, want %d", g, tt.greedy)
+				}
+				if tt.greedy < tt.want {
+					t.Errorf("greedy cost %d is lower than optimal %d", tt.greedy, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSolveAssignmentMatchesBruteForce(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	for n := 1; n <= 5; n++ {
+		for m := n; m <= 6; m++ {
+			t.Run(fmt.Sprintf("%dx%d", n, m), func(t *testing.T) {
+				for range 20 {
+					c := make([][]int64, n)
+					for i := range c {
+						c[i] = make([]int64, m)
+						for j := range c[i] {
+							c[i][j] = r.Int64N(100)
+						}
+					}
+					rowOf := solveAssignment(n, m, matrixCost(c))
+					got := assignmentCost(t, c, rowOf)
+					if want := bruteForceCost(c); got != want {
+						t.Fatalf("cost = %d, want %d for %v", got, want, c)
+					}
+					if g := greedyCost(c); got > g {
+						t.Fatalf("cost = %d is worse than greedy %d for %v", got, g, c)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestHungarianMatch(t *testing.T) {
+	now := time.Now()
+	chairs := []*Chair{
+		{ID: "c1", Latitude: 0, Longitude: 0, Speed: 1},
+		{ID: "c2", Latitude: 10, Longitude: 0, Speed: 1},
+	}
+	tests := []struct {
+		name  string
+		rides []*Ride
+		// ライドIDごとの割り当てる椅子
+		want map[string]string
+	}{
+		{
+			name:  "no rides",
+			rides: nil,
+			want:  map[string]string{},
+		},
+		{
+			name: "fewer rides than chairs",
+			rides: []*Ride{
+				{ID: "r1", PickupLatitude: 9, CreatedAt: now},
+			},
+			want: map[string]string{"r1": "c2"},
+		},
+		{
+			// 椅子の数だけ、所要時間の合計が最小になるライドを選ぶ
+			name: "more rides than chairs",
+			rides: []*Ride{
+				{ID: "r1", PickupLatitude: 1, CreatedAt: now},
+				{ID: "r2", PickupLatitude: 2, CreatedAt: now},
+				{ID: "r3", PickupLatitude: 11, CreatedAt: now},
+			},
+			want: map[string]string{"r1": "c1", "r3": "c2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[string]string{}
+			for _, a := range (&Hungarian{}).Match(now, tt.rides, chairs) {
+				got[a.Ride.ID] = a.Chair.ID
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+// Package matcher は待機中のライドと空いている椅子の割り当て方(マッチング戦略)を提供する
+package matcher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Ride struct {
+	ID                   string
+	PickupLatitude       int
+	PickupLongitude      int
+	DestinationLatitude  int
+	DestinationLongitude int
+	CreatedAt            time.Time
+}
+
+type Chair struct {
+	ID        string
+	Latitude  int
+	Longitude int
+	// chair_models.speed
+	Speed int
+}
+
+type Assignment struct {
+	Ride  *Ride
+	Chair *Chair
+	Score float64
+	// 椅子から配車位置までの距離
+	PD int
+	// 配車位置から目的地までの距離
+	DD int
+	// ライドが要求されてからの経過秒数
+	Age float64
+}
+
+// Matcher はライドと空いている椅子を受け取り、割り当てを返す
+// 1つのライド・椅子は高々1回しか割り当てない
+type Matcher interface {
+	Match(now time.Time, rides []*Ride, chairs []*Chair) []Assignment
+}
+
+const DefaultStrategy = "greedy"
+
+var strategies = map[string]func() Matcher{
+	"greedy":    func() Matcher { return &Greedy{} },
+	"hungarian": func() Matcher { return &Hungarian{} },
+}
+
+// New は名前からマッチング戦略を作る
+func New(name string) (Matcher, error) {
+	if name == "" {
+		name = DefaultStrategy
+	}
+	f, ok := strategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown matching strategy %q (available: %s)", name, strings.Join(Strategies(), ", "))
+	}
+	return f(), nil
+}
+
+// Strategies は利用可能な戦略名の一覧を返す
+func Strategies() []string {
+	names := make([]string, 0, len(strategies))
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// マンハッタン距離を求める
+func Distance(aLatitude, aLongitude, bLatitude, bLongitude int) int {
+	return abs(aLatitude-bLatitude) + abs(aLongitude-bLongitude)
+}
+
+func abs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+// 椅子が配車位置に着くまでにかかる時間(移動回数)
+func PickupTime(chair *Chair, ride *Ride) int {
+	speed := max(chair.Speed, 1)
+	d := Distance(chair.Latitude, chair.Longitude, ride.PickupLatitude, ride.PickupLongitude)
+	return (d + speed - 1) / speed
+}
+
+func newAssignment(now time.Time, ride *Ride, chair *Chair, score float64) Assignment {
+	return Assignment{
+		Ride:  ride,
+		Chair: chair,
+		Score: score,
+		PD:    Distance(chair.Latitude, chair.Longitude, ride.PickupLatitude, ride.PickupLongitude),
+		DD:    Distance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude),
+		Age:   now.Sub(ride.CreatedAt).Seconds(),
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon14/webapp/go/matcher"
+)
+
+// 複数のアプリホストが同時にマッチングしないよう、MySQLのadvisory lockでリーダーを1台に絞る
+const matchingLockName = "isuride_matching"
+
+const defaultMatchingInterval = 500 * time.Millisecond
+
+type matchingRunner struct {
+	mu sync.Mutex
+	// ISUCON_MATCHING_STRATEGY で指定したマッチング戦略
+	strategy string
+	// ループの間隔。ポーリングするクライアントに次回の問い合わせ時刻を伝えるのにも使う
+	interval time.Duration
+	// GET_LOCKはセッション単位なので、ロックを取った接続を持ち続ける
+	conn *sql.Conn
+}
+
+var matchingScheduler = &matchingRunner{}
+
+// ISUCON_MATCHING_INTERVAL(秒)を読む。0以下ならループを動かさない
+func matchingInterval() time.Duration {
+	v := os.Getenv("ISUCON_MATCHING_INTERVAL")
+	if v == "" {
+		return defaultMatchingInterval
+	}
+	sec, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		panic(fmt.Sprintf("failed to convert ISUCON_MATCHING_INTERVAL environment variable into float: %v", err))
+	}
+	return time.Duration(sec * float64(time.Second))
+}
+
+func startMatchingLoop() {
+	strategy := os.Getenv("ISUCON_MATCHING_STRATEGY")
+	if strategy == "" {
+		strategy = matcher.DefaultStrategy
+	}
+	m, err := matcher.New(strategy)
+	if err != nil {
+		panic(fmt.Sprintf("invalid ISUCON_MATCHING_STRATEGY environment variable: %v", err))
+	}
+	matchingScheduler.strategy = strategy
+
+	interval := matchingInterval()
+	matchingScheduler.interval = interval
+	if interval <= 0 {
+		slog.Info("matching loop is disabled")
+		return
+	}
+	slog.Info("starting matching loop", "interval", interval, "strategy", strategy)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if _, err := matchingScheduler.RunOnce(ctx, m, strategy); err != nil {
+				slog.Error("failed to run matching", "err", err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// リーダーであればマッチングを1回実行する。リーダーでなければ何もせず Leader=false を返す
+func (m *matchingRunner) RunOnce(ctx context.Context, strategy matcher.Matcher, name string) (*matchingResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	leader, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !leader {
+		return &matchingResult{Leader: false, Strategy: name}, nil
+	}
+	return runMatching(ctx, strategy, name)
+}
+
+func (m *matchingRunner) acquire(ctx context.Context) (bool, error) {
+	if m.conn != nil {
+		var held sql.NullBool
+		err := m.conn.QueryRowContext(ctx, "SELECT IS_USED_LOCK(?) = CONNECTION_ID()", matchingLockName).Scan(&held)
+		if err == nil && held.Valid && held.Bool {
+			return true, nil
+		}
+		// 接続が切れたなどでロックを失ったので取り直す
+		slog.Warn("lost matching leadership", "err", err)
+		m.release(ctx)
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	var got sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", matchingLockName).Scan(&got); err != nil {
+		conn.Close()
+		return false, err
+	}
+	if !got.Valid || got.Int64 != 1 {
+		conn.Close()
+		return false, nil
+	}
+	m.conn = conn
+	slog.Info("became matching leader")
+	return true, nil
+}
+
+func (m *matchingRunner) release(ctx context.Context) {
+	if m.conn == nil {
+		return
+	}
+	m.conn.ExecContext(ctx, "DO RELEASE_LOCK(?)", matchingLockName)
+	m.conn.Close()
+	m.conn = nil
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
 	"errors"
 	"net/http"
+	"os"
 	"sync"
 )
 
@@ -115,3 +117,21 @@ func chairAuthMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// オペレーター用のAPIは ISUCON_OPERATOR_TOKEN を Bearer トークンとして送ったときだけ使える
+// 未設定なら使えない
+func operatorAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("ISUCON_OPERATOR_TOKEN")
+		if token == "" {
+			writeError(w, http.StatusForbidden, errors.New("operator API is disabled"))
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid operator token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
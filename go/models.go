@@ -46,9 +46,41 @@ type User struct {
 }
 
 type PaymentToken struct {
+	ID        int64     `db:"id"`
 	UserID    string    `db:"user_id"`
 	Token     string    `db:"token"`
 	CreatedAt time.Time `db:"created_at"`
+	IsDefault bool      `db:"is_default"`
+}
+
+type Payment struct {
+	ID             string         `db:"id"`
+	RideID         string         `db:"ride_id"`
+	UserID         string         `db:"user_id"`
+	Token          string         `db:"token"`
+	Amount         int            `db:"amount"`
+	IdempotencyKey string         `db:"idempotency_key"`
+	Kind           string         `db:"kind"`
+	HoldKey        sql.NullString `db:"hold_key"`
+	Status         string         `db:"status"`
+	Attempts       int            `db:"attempts"`
+	LastError      sql.NullString `db:"last_error"`
+	NextAttemptAt  time.Time      `db:"next_attempt_at"`
+	CreatedAt      time.Time      `db:"created_at"`
+	UpdatedAt      time.Time      `db:"updated_at"`
+}
+
+type Refund struct {
+	ID             string         `db:"id"`
+	RideID         string         `db:"ride_id"`
+	PaymentID      string         `db:"payment_id"`
+	Amount         int            `db:"amount"`
+	Reason         string         `db:"reason"`
+	IdempotencyKey string         `db:"idempotency_key"`
+	Status         string         `db:"status"`
+	LastError      sql.NullString `db:"last_error"`
+	CreatedAt      time.Time      `db:"created_at"`
+	UpdatedAt      time.Time      `db:"updated_at"`
 }
 
 type Ride struct {
@@ -62,6 +94,19 @@ type Ride struct {
 	Evaluation           *int           `db:"evaluation"`
 	CreatedAt            time.Time      `db:"created_at"`
 	UpdatedAt            time.Time      `db:"updated_at"`
+	CanceledAt           sql.NullTime   `db:"canceled_at"`
+	// 決済をリトライしても二重に課金されないよう、ライドごとに固定する
+	PaymentIdempotencyKey string `db:"payment_idempotency_key"`
+	// 見積もったときの運賃ルール。運賃が変わっても履歴や売上はこのルールで計算する
+	FareRuleVersion int `db:"fare_rule_version"`
+	// 見積もったときのサージの倍率 (%)
+	SurgePercent int `db:"surge_percent"`
+	// 返金分を差し引いた売上。完了するまでは NULL
+	Sale sql.NullInt64 `db:"sale"`
+	// 見積もりIDで配車したときの割引後の運賃。あれば椅子のモデルによらずこの額を請求する
+	QuotedFare sql.NullInt64 `db:"quoted_fare"`
+	// 配車に使った見積もりID。同じ見積もりでは1回しか配車しない
+	QuoteID sql.NullString `db:"quote_id"`
 }
 
 type RideStatus struct {
@@ -70,6 +115,22 @@ type RideStatus struct {
 	CreatedAt time.Time `db:"created_at"`
 }
 
+type RideStatusEvent struct {
+	ID        int64     `db:"id"`
+	RideID    string    `db:"ride_id"`
+	Status    string    `db:"status"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type Notification struct {
+	ID         int64     `db:"id"`
+	TargetType string    `db:"target_type"`
+	TargetID   string    `db:"target_id"`
+	RideID     string    `db:"ride_id"`
+	Status     string    `db:"status"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
 type Owner struct {
 	ID                 string    `db:"id"`
 	Name               string    `db:"name"`
@@ -79,10 +140,58 @@ type Owner struct {
 	UpdatedAt          time.Time `db:"updated_at"`
 }
 
+type FareRule struct {
+	Version         int       `db:"version"`
+	EffectiveFrom   time.Time `db:"effective_from"`
+	InitialFare     int       `db:"initial_fare"`
+	FarePerDistance int       `db:"fare_per_distance"`
+	MinimumFare     int       `db:"minimum_fare"`
+	CreatedAt       time.Time `db:"created_at"`
+}
+
+type FareRuleDistanceTier struct {
+	Version         int `db:"version"`
+	FromDistance    int `db:"from_distance"`
+	FarePerDistance int `db:"fare_per_distance"`
+}
+
+type FareRuleModelMultiplier struct {
+	Version           int    `db:"version"`
+	Model             string `db:"model"`
+	MultiplierPercent int    `db:"multiplier_percent"`
+}
+
 type Coupon struct {
 	UserID    string    `db:"user_id"`
 	Code      string    `db:"code"`
 	Discount  int       `db:"discount"`
 	CreatedAt time.Time `db:"created_at"`
 	UsedBy    *string   `db:"used_by"`
+	// キャンペーンより前に付与されたクーポンは NULL (定額割引として扱う)
+	CampaignID sql.NullString `db:"campaign_id"`
+}
+
+type Invitation struct {
+	ID               int64          `db:"id"`
+	InviterID        string         `db:"inviter_id"`
+	InviteeID        string         `db:"invitee_id"`
+	InvitationCode   string         `db:"invitation_code"`
+	RewardCouponCode sql.NullString `db:"reward_coupon_code"`
+	CreatedAt        time.Time      `db:"created_at"`
+}
+
+type Campaign struct {
+	ID            string        `db:"id"`
+	CodePattern   string        `db:"code_pattern"`
+	DiscountType  string        `db:"discount_type"`
+	DiscountValue int           `db:"discount_value"`
+	MaxDiscount   sql.NullInt64 `db:"max_discount"`
+	StartsAt      sql.NullTime  `db:"starts_at"`
+	ExpiresAt     sql.NullTime  `db:"expires_at"`
+	PerUserLimit  sql.NullInt64 `db:"per_user_limit"`
+	GlobalLimit   sql.NullInt64 `db:"global_limit"`
+	FirstRideOnly bool          `db:"first_ride_only"`
+	MinFare       int           `db:"min_fare"`
+	Priority      int           `db:"priority"`
+	CreatedAt     time.Time     `db:"created_at"`
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// NotificationBus は保存済みの通知を、その通知先のSSEを持っているプロセスに届ける
+// 通知の本体は notifications テーブルにあるので、バスは「新しい通知がある」ことだけを伝える
+type NotificationBus interface {
+	// Publish は保存済みの通知を購読者に知らせる
+	Publish(n *Notification)
+	// Subscribe は通知先に新しい通知があるたびに値が届くチャネルと、購読をやめる関数を返す
+	Subscribe(targetType, targetID string) (<-chan struct{}, func())
+}
+
+var notificationBus NotificationBus = newMemoryNotificationBus()
+
+// ISUCON_NOTIFICATION_BUS で実装を選ぶ
+// memory: 同じプロセス内だけに届ける
+// mysql: notifications テーブルをポーリングして、他のホストで発行された通知も届ける
+func newNotificationBus(name string, db *sqlx.DB) (NotificationBus, error) {
+	switch name {
+	case "", "memory":
+		return newMemoryNotificationBus(), nil
+	case "mysql":
+		return newMySQLNotificationBus(db, 50*time.Millisecond), nil
+	default:
+		return nil, fmt.Errorf("unknown notification bus %q (available: memory, mysql)", name)
+	}
+}
+
+// このプロセスでSSEを待っている接続の一覧
+type localSubscribers struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]struct{}
+}
+
+func newLocalSubscribers() *localSubscribers {
+	return &localSubscribers{subs: map[string]map[chan struct{}]struct{}{}}
+}
+
+func (l *localSubscribers) subscribe(targetType, targetID string) (<-chan struct{}, func()) {
+	key := targetType + ":" + targetID
+	ch := make(chan struct{}, 1)
+
+	l.mu.Lock()
+	if l.subs[key] == nil {
+		l.subs[key] = map[chan struct{}]struct{}{}
+	}
+	l.subs[key][ch] = struct{}{}
+	l.mu.Unlock()
+
+	return ch, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.subs[key], ch)
+		if len(l.subs[key]) == 0 {
+			delete(l.subs, key)
+		}
+	}
+}
+
+func (l *localSubscribers) has(targetType, targetID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.subs[targetType+":"+targetID]) > 0
+}
+
+func (l *localSubscribers) wake(targetType, targetID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ch := range l.subs[targetType+":"+targetID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// すでに起こしてある
+		}
+	}
+}
+
+type memoryNotificationBus struct {
+	local *localSubscribers
+}
+
+func newMemoryNotificationBus() *memoryNotificationBus {
+	return &memoryNotificationBus{local: newLocalSubscribers()}
+}
+
+func (b *memoryNotificationBus) Publish(n *Notification) {
+	b.local.wake(n.TargetType, n.TargetID)
+}
+
+func (b *memoryNotificationBus) Subscribe(targetType, targetID string) (<-chan struct{}, func()) {
+	return b.local.subscribe(targetType, targetID)
+}
+
+// notifications テーブルを定期的に読み、このプロセスに購読者がいる通知先を起こす
+// 自プロセスで発行した通知はポーリングを待たずにすぐ届ける
+type mySQLNotificationBus struct {
+	local    *localSubscribers
+	db       *sqlx.DB
+	interval time.Duration
+}
+
+// AUTO_INCREMENTのIDはコミット順と一致しないので、少し前まで遡って読み直す
+const notificationBusLookback = time.Second
+
+func newMySQLNotificationBus(db *sqlx.DB, interval time.Duration) *mySQLNotificationBus {
+	b := &mySQLNotificationBus{
+		local:    newLocalSubscribers(),
+		db:       db,
+		interval: interval,
+	}
+	go b.poll()
+	return b
+}
+
+func (b *mySQLNotificationBus) Publish(n *Notification) {
+	b.local.wake(n.TargetType, n.TargetID)
+}
+
+func (b *mySQLNotificationBus) Subscribe(targetType, targetID string) (<-chan struct{}, func()) {
+	return b.local.subscribe(targetType, targetID)
+}
+
+func (b *mySQLNotificationBus) poll() {
+	var since time.Time
+	if err := b.db.Get(&since, `SELECT NOW(6)`); err != nil {
+		slog.Error("failed to start notification bus", "err", err)
+		since = time.Now()
+	}
+	// 遡って読み直した通知を二重に起こさないよう、起こした通知IDを覚えておく
+	seen := map[int64]time.Time{}
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var rows []struct {
+			ID         int64     `db:"id"`
+			TargetType string    `db:"target_type"`
+			TargetID   string    `db:"target_id"`
+			CreatedAt  time.Time `db:"created_at"`
+			Now        time.Time `db:"now"`
+		}
+		if err := b.db.Select(
+			&rows,
+			`SELECT id, target_type, target_id, created_at, NOW(6) AS now FROM notifications WHERE created_at >= ? ORDER BY id`,
+			since.Add(-notificationBusLookback),
+		); err != nil {
+			slog.Error("failed to poll notifications", "err", err)
+			continue
+		}
+
+		for _, row := range rows {
+			if _, ok := seen[row.ID]; ok {
+				continue
+			}
+			seen[row.ID] = row.CreatedAt
+			if b.local.has(row.TargetType, row.TargetID) {
+				b.local.wake(row.TargetType, row.TargetID)
+			}
+			if row.Now.After(since) {
+				since = row.Now
+			}
+		}
+		for id, createdAt := range seen {
+			if createdAt.Before(since.Add(-2 * notificationBusLookback)) {
+				delete(seen, id)
+			}
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/jmoiron/sqlx"
+)
+
+// 通知はすべて notifications テーブルに保存し、そのIDをSSEのイベントIDとして使う
+// notificationBus は「新しい通知がある」ことを知らせるだけなので、
+// 起こし損ねても通知そのものは失われない
+const (
+	notificationTargetUser  = "user"
+	notificationTargetChair = "chair"
+)
+
+type notify struct {
+	ID     int64
+	Ride   *Ride
+	Status string
+}
+
+const (
+	notificationPingInterval = 15 * time.Second
+	// これより古い通知は送り終わったものとして消す。Last-Event-ID で遡れるのはこの範囲まで
+	notificationRetention     = 10 * time.Minute
+	notificationPruneInterval = time.Minute
+	// シャットダウン時にクライアントへ伝える再接続までの待ち時間
+	notificationRetryAfter = time.Second
+)
+
+// シャットダウン時に閉じる。SSEの接続はこれを見て retry を送ってから終わる
+var notificationShutdown = make(chan struct{})
+
+var closeNotificationStreams = sync.OnceFunc(func() {
+	close(notificationShutdown)
+})
+
+// 接続ごとに最後に送った通知ID。Last-Event-ID無しで再接続されたときはここから再開する
+var notificationCursors = sync.Map{}
+
+// 通知を保存してから、SSEで待っている接続を起こす
+func publishNotification(targetType, targetID string, ride *Ride, status string) {
+	res, err := db2.Exec(
+		`INSERT INTO notifications (target_type, target_id, ride_id, status) VALUES (?, ?, ?, ?)`,
+		targetType, targetID, ride.ID, status,
+	)
+	if err != nil {
+		slog.Error("failed to save notification", "target_type", targetType, "target_id", targetID, "ride_id", ride.ID, "status", status, "err", err)
+		return
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		slog.Error("failed to save notification", "target_type", targetType, "target_id", targetID, "ride_id", ride.ID, "status", status, "err", err)
+		return
+	}
+	notificationBus.Publish(&Notification{ID: id, TargetType: targetType, TargetID: targetID, RideID: ride.ID, Status: status})
+}
+
+func startNotificationPruner() {
+	go func() {
+		ticker := time.NewTicker(notificationPruneInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := pruneNotifications(); err != nil {
+				slog.Error("failed to prune notifications", "err", err)
+			}
+		}
+	}()
+}
+
+// notificationRetention より古い通知を消す
+// カーソルの初期位置とポーリングは通知先ごとの最新の通知を使うので、それだけは古くても残す
+// 消した位置は notification_prunes に残し、それより前から再開しようとしたクライアントには reset を送る
+func pruneNotifications() error {
+	tx2, err := db2.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx2.Rollback()
+
+	if _, err := tx2.Exec(
+		`INSERT INTO notification_prunes (target_type, target_id, pruned_id)
+		SELECT n.target_type, n.target_id, MAX(n.id) FROM notifications n
+		JOIN (SELECT target_type, target_id, MAX(id) AS latest_id FROM notifications GROUP BY target_type, target_id) latest
+			ON latest.target_type = n.target_type AND latest.target_id = n.target_id
+		WHERE n.created_at < NOW(6) - INTERVAL ? MICROSECOND AND n.id < latest.latest_id
+		GROUP BY n.target_type, n.target_id
+		ON DUPLICATE KEY UPDATE pruned_id = GREATEST(pruned_id, VALUES(pruned_id))`,
+		notificationRetention.Microseconds(),
+	); err != nil {
+		return err
+	}
+	res, err := tx2.Exec(
+		`DELETE n FROM notifications n
+		JOIN notification_prunes p ON p.target_type = n.target_type AND p.target_id = n.target_id
+		WHERE n.id <= p.pruned_id`,
+	)
+	if err != nil {
+		return err
+	}
+	if err := tx2.Commit(); err != nil {
+		return err
+	}
+	if pruned, err := res.RowsAffected(); err == nil && pruned > 0 {
+		slog.Debug("pruned notifications", "count", pruned)
+	}
+	return nil
+}
+
+// 通知先の通知をどこまで消したかを返す。消していなければ0
+func prunedNotificationID(targetType, targetID string) (int64, error) {
+	var pruned int64
+	if err := db2.Get(
+		&pruned,
+		`SELECT pruned_id FROM notification_prunes WHERE target_type = ? AND target_id = ?`,
+		targetType, targetID,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return pruned, nil
+}
+
+// afterID より後の通知を古い順に返す。last は読んだ最後の通知ID (無ければ afterID)
+// 通知に保存しているのはステータスだけで、ライドの他の項目 (運賃・評価など) は読み出した時点の rides の行を使う
+// ライドの行が見つからない通知はログに残して飛ばす。last はその通知も含むので、次はその先から読む
+func loadNotifications(targetType, targetID string, afterID int64) ([]notify, int64, error) {
+	rows := []Notification{}
+	if err := db2.Select(
+		&rows,
+		`SELECT * FROM notifications WHERE target_type = ? AND target_id = ? AND id > ? ORDER BY id`,
+		targetType, targetID, afterID,
+	); err != nil {
+		return nil, afterID, err
+	}
+	if len(rows) == 0 {
+		return nil, afterID, nil
+	}
+
+	rideIDs := make([]string, 0, len(rows))
+	for _, n := range rows {
+		rideIDs = append(rideIDs, n.RideID)
+	}
+	query, args, err := sqlx.In(`SELECT * FROM rides WHERE id IN (?)`, rideIDs)
+	if err != nil {
+		return nil, afterID, err
+	}
+	rides := []*Ride{}
+	if err := db.Select(&rides, query, args...); err != nil {
+		return nil, afterID, err
+	}
+	rideByID := make(map[string]*Ride, len(rides))
+	for _, ride := range rides {
+		rideByID[ride.ID] = ride
+	}
+
+	notifies := make([]notify, 0, len(rows))
+	for _, n := range rows {
+		ride, ok := rideByID[n.RideID]
+		if !ok {
+			slog.Error("skipped notification whose ride is not found", "id", n.ID, "ride_id", n.RideID, "target_type", targetType, "target_id", targetID)
+			continue
+		}
+		notifies = append(notifies, notify{ID: n.ID, Ride: ride, Status: n.Status})
+	}
+	return notifies, rows[len(rows)-1].ID, nil
+}
+
+// どの通知から送り始めるかを決める
+// Last-Event-ID があればその続きから、無ければ notificationCursor から送る
+func notificationStartID(r *http.Request, targetType, targetID string) (int64, error) {
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid Last-Event-ID: %w", err)
+		}
+		return id, nil
+	}
+	return notificationCursor(targetType, targetID)
+}
+
+// このプロセスで最後に送った通知IDを返す。まだ送っていなければ最新の通知1件から送る
+func notificationCursor(targetType, targetID string) (int64, error) {
+	if v, ok := notificationCursors.Load(targetType + ":" + targetID); ok {
+		return v.(int64), nil
+	}
+	latest, err := latestNotificationID(targetType, targetID)
+	if err != nil || latest == 0 {
+		return 0, err
+	}
+	return latest - 1, nil
+}
+
+func latestNotificationID(targetType, targetID string) (int64, error) {
+	var latest int64
+	if err := db2.Get(
+		&latest,
+		`SELECT id FROM notifications WHERE target_type = ? AND target_id = ? ORDER BY id DESC LIMIT 1`,
+		targetType, targetID,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return latest, nil
+}
+
+// ポーリング用に通知を1件返す。SSEと同じカーソルを進めるので、どちらで受けても食い違わない
+// 途中のステータスを飛ばさないよう未読のうち最も古いものを返し、pending で未読が残っているかを返す
+// 未読が無ければ最新の通知をもう一度返し、通知が1件も無ければ nil を返す
+func nextNotification(targetType, targetID string) (*notify, bool, error) {
+	cursor, err := notificationCursor(targetType, targetID)
+	if err != nil {
+		return nil, false, err
+	}
+	pruned, err := prunedNotificationID(targetType, targetID)
+	if err != nil {
+		return nil, false, err
+	}
+	if cursor < pruned {
+		// ポーリングは1件ずつ返すので、消えた分は飛ばして残っている通知から返す
+		slog.Warn("skipped pruned notifications", "target_type", targetType, "target_id", targetID, "cursor", cursor, "pruned_id", pruned)
+		cursor = pruned
+	}
+	notifies, last, err := loadNotifications(targetType, targetID, cursor)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(notifies) > 0 {
+		n := notifies[0]
+		notificationCursors.Store(targetType+":"+targetID, n.ID)
+		return &n, len(notifies) > 1, nil
+	}
+	if last > cursor {
+		notificationCursors.Store(targetType+":"+targetID, last)
+	}
+
+	latest, err := latestNotificationID(targetType, targetID)
+	if err != nil || latest == 0 {
+		return nil, false, err
+	}
+	notifies, _, err = loadNotifications(targetType, targetID, latest-1)
+	if err != nil || len(notifies) == 0 {
+		return nil, false, err
+	}
+	return &notifies[0], false, nil
+}
+
+// ポーリングするクライアントに返す次回の問い合わせまでの時間
+// マッチング待ちなら次のマッチングまで待たせ、走行中は椅子の座標送信で進むのでその半分で確認させる
+func notificationRetryAfterMs(n *notify, pending bool) int {
+	if pending {
+		return 0
+	}
+	interval := matchingScheduler.interval
+	if interval <= 0 {
+		// ループを止めているときも、外部からの /api/internal/matching はこの間隔を想定している
+		interval = defaultMatchingInterval
+	}
+	if n == nil || n.Status == "MATCHING" {
+		return int(interval.Milliseconds())
+	}
+	return int((interval / 2).Milliseconds())
+}
+
+func acceptsEventStream(r *http.Request) bool {
+	return acceptsMediaType(r, "text/event-stream")
+}
+
+func acceptsCSV(r *http.Request) bool {
+	return acceptsMediaType(r, "text/csv")
+}
+
+func acceptsMediaType(r *http.Request, want string) bool {
+	for _, v := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(v, ",") {
+			if mt, _, _ := strings.Cut(strings.TrimSpace(mediaType), ";"); strings.EqualFold(mt, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 通知をSSEで送り続ける。send は1件の通知をクライアントに書き出す
+func streamNotifications(w http.ResponseWriter, r *http.Request, targetType, targetID string, send func(n notify) error) {
+	startID, err := notificationStartID(r, targetType, targetID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// 購読してから読み始めないと、その間に届いた通知を取りこぼす
+	ch, unsubscribe := notificationBus.Subscribe(targetType, targetID)
+	defer unsubscribe()
+
+	// Server Sent Events
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	// 初回送信を必ず行う
+	if err := writeSSE(w, 0, nil); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to send sse at first: %w", err))
+		return
+	}
+
+	ping := time.NewTicker(notificationPingInterval)
+	defer ping.Stop()
+
+	cursor := startID
+	pruned, err := prunedNotificationID(targetType, targetID)
+	if err != nil {
+		slog.Warn("failed to load pruned notification id:", "error", err)
+		return
+	}
+	if cursor < pruned {
+		// 再開したい位置の通知はもう消したので、飛ばしたことを伝えてから残っている通知を送る
+		if err := writeSSEReset(w, cursor, pruned); err != nil {
+			slog.Warn("failed to send sse reset:", "error", err)
+			return
+		}
+		cursor = pruned
+	}
+
+	for {
+		notifies, last, err := loadNotifications(targetType, targetID, cursor)
+		if err != nil {
+			slog.Warn("failed to load notifications:", "error", err)
+			return
+		}
+		for _, n := range notifies {
+			slog.Debug("received", targetType+" notification", n)
+			if err := send(n); err != nil {
+				slog.Warn("failed to send sse:", "error", err)
+				return
+			}
+			cursor = n.ID
+			notificationCursors.Store(targetType+":"+targetID, cursor)
+		}
+		if last > cursor {
+			// ライドが見つからずに飛ばした通知を読み直さない
+			cursor = last
+			notificationCursors.Store(targetType+":"+targetID, cursor)
+		}
+		if len(notifies) > 0 {
+			continue
+		}
+
+		slog.Debug("waiting", targetType, targetID)
+		select {
+		case <-r.Context().Done():
+			return
+		case <-notificationShutdown:
+			// 再接続先が立ち上がるまで少し待ってもらう
+			if err := writeSSERetry(w, notificationRetryAfter); err != nil {
+				slog.Warn("failed to send sse retry:", "error", err)
+			}
+			return
+		case <-ch:
+		case <-ping.C:
+			// プロキシにアイドルとみなされて切られないようにする
+			// 起こし損ねた通知があればここで拾われる
+			if err := writeSSEComment(w, "ping"); err != nil {
+				slog.Warn("failed to send sse ping:", "error", err)
+				return
+			}
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, id int64, data interface{}) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	msg := "data: " + string(buf) + "\n\n"
+	if id > 0 {
+		msg = "id: " + strconv.FormatInt(id, 10) + "\n" + msg
+	}
+	_, err = w.Write([]byte(msg))
+	if err != nil {
+		return err
+	}
+
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	return nil
+}
+
+type notificationResetEvent struct {
+	// クライアントが再開しようとした位置
+	LastEventID int64 `json:"last_event_id"`
+	// このIDまでの通知は消したので送れない。次に送る通知でライドの状態を取り直す
+	PrunedID int64 `json:"pruned_id"`
+}
+
+// 再開しようとした位置からの通知の一部をもう消したことを reset イベントで伝える
+func writeSSEReset(w http.ResponseWriter, lastEventID, prunedID int64) error {
+	buf, err := json.Marshal(notificationResetEvent{LastEventID: lastEventID, PrunedID: prunedID})
+	if err != nil {
+		return err
+	}
+	msg := "event: reset\nid: " + strconv.FormatInt(prunedID, 10) + "\ndata: " + string(buf) + "\n\n"
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func writeSSEComment(w http.ResponseWriter, comment string) error {
+	if _, err := w.Write([]byte(": " + comment + "\n\n")); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func writeSSERetry(w http.ResponseWriter, retry time.Duration) error {
+	if _, err := w.Write([]byte("retry: " + strconv.FormatInt(retry.Milliseconds(), 10) + "\n\n")); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
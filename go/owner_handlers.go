@@ -2,7 +2,9 @@ package main
 
 import (
 	"database/sql"
+	"encoding/csv"
 	"errors"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"time"
@@ -10,11 +12,6 @@ import (
 	"github.com/oklog/ulid/v2"
 )
 
-const (
-	initialFare     = 500
-	farePerDistance = 100
-)
-
 type ownerPostOwnersRequest struct {
 	Name string `json:"name"`
 }
@@ -75,87 +72,191 @@ type ownerGetSalesResponse struct {
 	TotalSales int          `json:"total_sales"`
 	Chairs     []chairSales `json:"chairs"`
 	Models     []modelSales `json:"models"`
+	// group_by を指定したときの期間ごとの売上。売上の無い期間は含まない
+	Periods []periodSales `json:"periods,omitempty"`
+}
+
+type periodSales struct {
+	// 期間の初日 (UTC, YYYY-MM-DD)
+	Period     string       `json:"period"`
+	TotalSales int          `json:"total_sales"`
+	Chairs     []chairSales `json:"chairs"`
+	Models     []modelSales `json:"models"`
+}
+
+// group_by ごとの、完了日時から期間の初日を求める式。週は月曜日から
+// group_by なしは全体を1つの期間として椅子ごとにだけ集計する
+var salesPeriodExprs = map[string]string{
+	"":      `''`,
+	"day":   `DATE_FORMAT(rides.updated_at, '%Y-%m-%d')`,
+	"week":  `DATE_FORMAT(DATE(rides.updated_at) - INTERVAL WEEKDAY(rides.updated_at) DAY, '%Y-%m-%d')`,
+	"month": `DATE_FORMAT(rides.updated_at, '%Y-%m-01')`,
+}
+
+// 売上の集計の1行。Level は GROUPING(model, chair_id, period) のビットで、どの単位の合計かを表す
+type chairPeriodSales struct {
+	Level     int    `db:"grouping_level"`
+	Period    string `db:"period"`
+	Model     string `db:"model"`
+	ChairID   string `db:"chair_id"`
+	ChairName string `db:"chair_name"`
+	Sales     int    `db:"sales"`
+	Rides     int    `db:"rides"`
 }
 
+const (
+	salesLevelPeriod = 0 // 椅子・期間ごと
+	salesLevelChair  = 1 // 椅子ごと
+	salesLevelModel  = 3 // モデルごと
+	salesLevelTotal  = 7 // 全体
+)
+
+// since, until (ミリ秒) の間に完了したライドの売上を椅子ごと・モデルごとに返す
+// group_by=day|week|month なら期間ごとにも分け、Accept: text/csv なら期間・椅子ごとの行をCSVで返す
 func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 	since := time.Unix(0, 0)
 	until := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
-	if r.URL.Query().Get("since") != "" {
-		parsed, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
-		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-		}
-		since = time.UnixMilli(parsed)
+	if t, err := parseUnixMilliQuery(r, "since"); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	} else if t != nil {
+		since = *t
 	}
-	if r.URL.Query().Get("until") != "" {
-		parsed, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
-		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-		}
-		until = time.UnixMilli(parsed)
+	if t, err := parseUnixMilliQuery(r, "until"); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	} else if t != nil {
+		until = *t
 	}
-
-	owner := r.Context().Value("owner").(*Owner)
-
-	tx, err := db.Beginx()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+	groupBy := r.URL.Query().Get("group_by")
+	periodExpr, ok := salesPeriodExprs[groupBy]
+	if !ok {
+		writeError(w, http.StatusBadRequest, errors.New("group_by must be one of day, week, month"))
 		return
 	}
-	defer tx.Rollback()
 
-	chairs := []Chair{}
-	if err := tx.Select(&chairs, "SELECT * FROM chairs WHERE owner_id = ?", owner.ID); err != nil {
+	owner := r.Context().Value("owner").(*Owner)
+
+	// 売上は完了したときに rides.sale に記録してあるので、椅子・期間ごとの行と
+	// 椅子ごと・モデルごと・全体の合計を ROLLUP で1回のクエリで集計する
+	// 売上の無い椅子も返すので chairs から LEFT JOIN する
+	rows := []chairPeriodSales{}
+	if err := db.Select(
+		&rows,
+		`SELECT GROUPING(chairs.model, chairs.id, `+periodExpr+`) AS grouping_level,
+		        IFNULL(`+periodExpr+`, '') AS period,
+		        IFNULL(chairs.model, '') AS model,
+		        IFNULL(chairs.id, '') AS chair_id,
+		        IFNULL(ANY_VALUE(chairs.name), '') AS chair_name,
+		        IFNULL(SUM(rides.sale), 0) AS sales,
+		        COUNT(rides.id) AS rides
+		 FROM chairs
+		 LEFT JOIN rides ON rides.chair_id = chairs.id AND rides.evaluation IS NOT NULL AND rides.updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND
+		 WHERE chairs.owner_id = ?
+		 GROUP BY chairs.model, chairs.id, `+periodExpr+` WITH ROLLUP
+		 ORDER BY grouping_level, period, chairs.id, chairs.model`,
+		since, until, owner.ID,
+	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	res := ownerGetSalesResponse{
 		TotalSales: 0,
+		Models:     []modelSales{},
 	}
-
-	modelSalesByModel := map[string]int{}
-	for _, chair := range chairs {
-		rides := []Ride{}
-		if err := tx.Select(&rides, "SELECT * FROM rides WHERE chair_id=? AND evaluation IS NOT NULL AND updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND", chair.ID, since, until); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+	periodRows := []chairPeriodSales{}
+	for _, row := range rows {
+		switch row.Level {
+		case salesLevelPeriod:
+			// ライドの無い椅子も LEFT JOIN で1行できるので除く
+			if row.Rides > 0 {
+				periodRows = append(periodRows, row)
+			}
+		case salesLevelChair:
+			res.Chairs = append(res.Chairs, chairSales{
+				ID:    row.ChairID,
+				Name:  row.ChairName,
+				Sales: row.Sales,
+			})
+		case salesLevelModel:
+			res.Models = append(res.Models, modelSales{
+				Model: row.Model,
+				Sales: row.Sales,
+			})
+		case salesLevelTotal:
+			res.TotalSales = row.Sales
 		}
+	}
 
-		sales := sumSales(rides)
-		res.TotalSales += sales
-
-		res.Chairs = append(res.Chairs, chairSales{
-			ID:    chair.ID,
-			Name:  chair.Name,
-			Sales: sales,
-		})
-
-		modelSalesByModel[chair.Model] += sales
+	if acceptsCSV(r) {
+		writeSalesCSV(w, periodRows, groupBy != "")
+		return
 	}
 
-	models := []modelSales{}
-	for model, sales := range modelSalesByModel {
-		models = append(models, modelSales{
-			Model: model,
-			Sales: sales,
-		})
+	if groupBy != "" {
+		res.Periods = groupSalesByPeriod(periodRows)
 	}
-	res.Models = models
 
 	writeJSON(w, http.StatusOK, res)
 }
 
-func sumSales(rides []Ride) int {
-	sale := 0
-	for _, ride := range rides {
-		sale += calculateSale(ride)
+// 期間順に並んだ椅子・期間ごとの行を期間ごとにまとめる
+func groupSalesByPeriod(rows []chairPeriodSales) []periodSales {
+	periods := []periodSales{}
+	modelIndex := map[string]int{}
+	for _, row := range rows {
+		if len(periods) == 0 || periods[len(periods)-1].Period != row.Period {
+			periods = append(periods, periodSales{Period: row.Period, Chairs: []chairSales{}, Models: []modelSales{}})
+			clear(modelIndex)
+		}
+		p := &periods[len(periods)-1]
+		p.TotalSales += row.Sales
+		p.Chairs = append(p.Chairs, chairSales{
+			ID:    row.ChairID,
+			Name:  row.ChairName,
+			Sales: row.Sales,
+		})
+		if i, ok := modelIndex[row.Model]; ok {
+			p.Models[i].Sales += row.Sales
+		} else {
+			modelIndex[row.Model] = len(p.Models)
+			p.Models = append(p.Models, modelSales{Model: row.Model, Sales: row.Sales})
+		}
 	}
-	return sale
+	return periods
 }
 
-func calculateSale(ride Ride) int {
-	return calculateFare(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+// withPeriod が false (group_by なし) なら期間が無いので period 列を出さない
+func writeSalesCSV(w http.ResponseWriter, rows []chairPeriodSales, withPeriod bool) {
+	w.Header().Set("Content-Type", "text/csv;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	cw := csv.NewWriter(w)
+	header := []string{"chair_id", "chair_name", "model", "sales"}
+	if withPeriod {
+		header = append([]string{"period"}, header...)
+	}
+	cw.Write(header)
+	for _, row := range rows {
+		record := []string{row.ChairID, row.ChairName, row.Model, strconv.Itoa(row.Sales)}
+		if withPeriod {
+			record = append([]string{row.Period}, record...)
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		slog.Error("failed to write sales csv", "err", err)
+	}
+}
+
+// ライドを見積もったときのルールとサージ、割り当てられた椅子のモデルで計算した売上 (割引前)
+func rideSale(ride *Ride) (int, error) {
+	rule, model, err := rideFareRule(ride)
+	if err != nil {
+		return 0, err
+	}
+	return rule.Fare(calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude), model, ride.SurgePercent), nil
 }
 
 type chairWithDetail struct {
@@ -2,13 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"log/slog"
+	"io"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/goccy/go-json"
-	"github.com/oklog/ulid/v2"
+	"github.com/isucon/isucon14/webapp/go/upstream"
 )
 
 var erroredUpstream = errors.New("errored upstream")
@@ -22,54 +25,130 @@ type paymentGatewayGetPaymentsResponseOne struct {
 	Status string `json:"status"`
 }
 
-var paymentSem = make(chan struct{}, 100)
+// 決済ゲートウェイへのリクエストの上限 (リトライを含む)
+const paymentGatewayTimeout = 10 * time.Second
 
-func requestPaymentGatewayPostPayment(paymentGatewayURL string, token string, param *paymentGatewayPostPaymentRequest, retrieveRidesOrderByCreatedAtAsc func() ([]Ride, error)) error {
-	b, err := json.Marshal(param)
-	if err != nil {
-		return err
+// FIXME: 社内決済マイクロサービスのインフラに異常が発生していて、同時にたくさんリクエストすると変なことになる可能性あり
+// 同時に送る数は payments のワーカー数で抑え、リトライはジッター付きのバックオフで散らす
+var paymentGatewayClient = &upstream.Client{
+	HTTPClient: &http.Client{},
+	Policy: upstream.Policy{
+		AttemptTimeout: 2 * time.Second,
+		MaxAttempts:    4,
+		BaseBackoff:    50 * time.Millisecond,
+		MaxBackoff:     time.Second,
+	},
+	Breaker: upstream.NewCircuitBreaker(10, 5*time.Second),
+}
+
+// ゲートウェイが決済を受け付けなかったことが確実なエラー
+// これ以外のエラー (タイムアウトや5xx) では決済されたかどうか分からない
+type paymentRejectedError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *paymentRejectedError) Error() string {
+	return fmt.Sprintf("payment gateway rejected the payment: status code %d: %s", e.StatusCode, e.Body)
+}
+
+// サーキットが開いている間は決済を受け付けない
+func checkPaymentGateway() error {
+	if paymentGatewayClient.Breaker.IsOpen() {
+		return fmt.Errorf("%w: %w", erroredUpstream, upstream.ErrCircuitOpen)
+	}
+	return nil
+}
+
+func getPaymentGatewayURL() (string, error) {
+	if u, ok := urlCache.Load("payment_gateway_url"); ok {
+		return u.(string), nil
 	}
-	// 2つまでのリクエストを同時に送る
-	paymentSem <- struct{}{}
-	defer func() { <-paymentSem }()
-	idempotencyKey := ulid.Make().String()
-
-	// 失敗したらとりあえずリトライ
-	// FIXME: 社内決済マイクロサービスのインフラに異常が発生していて、同時にたくさんリクエストすると変なことになる可能性あり
-	retry := 0
-	for {
-		err := func() error {
-			req, err := http.NewRequest(http.MethodPost, paymentGatewayURL+"/payments", bytes.NewBuffer(b))
-			if err != nil {
-				return err
-			}
-			req.Header.Set("Content-Type", "application/json")
-			req.Header.Set("Authorization", "Bearer "+token)
-			req.Header.Set("Idempotency-Key", idempotencyKey)
-
-			res, err := http.DefaultClient.Do(req)
-			if err != nil {
-				return fmt.Errorf("failed to POST request to payment gateway: %w", err)
-			}
-			defer res.Body.Close()
-
-			if res.StatusCode != http.StatusNoContent {
-				return fmt.Errorf("failed to POST request to payment gateway: status code is not 204, got %d", res.StatusCode)
-			}
-			return nil
-		}()
+	var paymentGatewayURL string
+	if err := db.Get(&paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+		return "", err
+	}
+	urlCache.Store("payment_gateway_url", paymentGatewayURL)
+	return paymentGatewayURL, nil
+}
+
+// 決済を送る。一時的な失敗は同じ冪等キーでリトライする
+func requestPaymentGatewayPostPayment(paymentGatewayURL string, token string, idempotencyKey string, param *paymentGatewayPostPaymentRequest) error {
+	return postPaymentGateway(paymentGatewayURL+"/payments", token, idempotencyKey, param)
+}
+
+type paymentGatewayPostRefundRequest struct {
+	Amount int `json:"amount"`
+}
+
+// 決済の一部または全部を返金する。paymentKey は返金する決済を送ったときの冪等キー
+func requestPaymentGatewayPostRefund(paymentGatewayURL string, token string, paymentKey string, idempotencyKey string, param *paymentGatewayPostRefundRequest) error {
+	return postPaymentGateway(paymentGatewayURL+"/payments/"+url.PathEscape(paymentKey)+"/refunds", token, idempotencyKey, param)
+}
+
+type paymentGatewayPostHoldRequest struct {
+	Amount int `json:"amount"`
+}
+
+// 与信を取る。holdKey が与信の冪等キーになり、確定・取り消しでも使う
+func requestPaymentGatewayPostHold(paymentGatewayURL string, token string, holdKey string, param *paymentGatewayPostHoldRequest) error {
+	return postPaymentGateway(paymentGatewayURL+"/holds", token, holdKey, param)
+}
+
+type paymentGatewayPostCaptureRequest struct {
+	Amount int `json:"amount"`
+}
+
+// 与信の範囲で決済を確定する。idempotencyKey は確定した決済の冪等キーで、返金でも使う
+func requestPaymentGatewayPostCapture(paymentGatewayURL string, token string, holdKey string, idempotencyKey string, param *paymentGatewayPostCaptureRequest) error {
+	return postPaymentGateway(paymentGatewayURL+"/holds/"+url.PathEscape(holdKey)+"/capture", token, idempotencyKey, param)
+}
+
+// 与信を取り消す
+// 与信が記録されていなければ (取れたか分からなかった与信が取れていなかった) 取り消すものは無いので成功とみなす
+func requestPaymentGatewayPostVoid(paymentGatewayURL string, token string, holdKey string) error {
+	err := postPaymentGateway(paymentGatewayURL+"/holds/"+url.PathEscape(holdKey)+"/void", token, holdKey, nil)
+	var rejected *paymentRejectedError
+	if errors.As(err, &rejected) && rejected.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// 204 が返るまで同じ冪等キーでリトライする
+// 4xx (リトライ対象を除く) は受け付けられなかったことが確実なので paymentRejectedError を返す
+func postPaymentGateway(endpoint string, token string, idempotencyKey string, param any) error {
+	var b []byte
+	if param != nil {
+		var err error
+		if b, err = json.Marshal(param); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), paymentGatewayTimeout)
+	defer cancel()
+	res, err := paymentGatewayClient.Do(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(b))
 		if err != nil {
-			if retry < 5 {
-				retry++
-				//time.Sleep(100 * time.Millisecond)
-				continue
-			} else {
-				slog.Error("failed to request to payment gateway", "retry", retry, "err", err)
-				return err
-			}
+			return nil, err
 		}
-		break
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+		return req, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to POST request to payment gateway: %w: %w", erroredUpstream, err)
 	}
+	defer res.Body.Close()
 
-	return nil
+	if res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode >= 400 && res.StatusCode < 500 && !upstream.RetryableStatus(res.StatusCode) {
+		return &paymentRejectedError{StatusCode: res.StatusCode, Body: string(body)}
+	}
+	return fmt.Errorf("failed to POST request to payment gateway: %w: status code is not 204, got %d", erroredUpstream, res.StatusCode)
 }
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// 決済はライドを COMPLETED にするトランザクションで payments に記録し (アウトボックス)、
+// ワーカーがゲートウェイに送る
+// ライドの作成時に与信を取ったものは HELD で記録しておき、完了で確定 (CAPTURE)、キャンセルで取り消し (VOID) を送る
+//
+// PLACING:   与信を取りに行っている。取れたか分からないまま残ったら、リコンサイラが取り消す (VOID) を積む
+// HELD:      与信を取ってライドの完了を待っている
+// PENDING:   まだ送っていない、または送っていないことが確定した
+// UNKNOWN:   送信中、または送ったが決済されたか分からない。リコンサイラが同じ冪等キーで送り直す
+// SUCCEEDED: 決済された
+// FAILED:    ゲートウェイに拒否された
+// ABANDONED: paymentMaxAttempts 回送っても決済されたか分からなかった。手で確認するまで送らない
+const (
+	paymentStatusPlacing   = "PLACING"
+	paymentStatusHeld      = "HELD"
+	paymentStatusPending   = "PENDING"
+	paymentStatusUnknown   = "UNKNOWN"
+	paymentStatusSucceeded = "SUCCEEDED"
+	paymentStatusFailed    = "FAILED"
+	paymentStatusAbandoned = "ABANDONED"
+)
+
+// ゲートウェイに送るもの
+const (
+	paymentKindCharge  = "CHARGE"
+	paymentKindCapture = "CAPTURE"
+	paymentKindVoid    = "VOID"
+)
+
+const (
+	paymentWorkers           = 10
+	paymentPollInterval      = 100 * time.Millisecond
+	paymentReconcileInterval = time.Second
+	// これより前に送信を始めた UNKNOWN はもう応答が返ってこない
+	paymentInFlightTimeout = 2 * paymentGatewayTimeout
+	// 決済されたか分からないまま送り直すのはこの回数まで
+	paymentMaxAttempts = 10
+)
+
+var paymentDoorbell = make(chan struct{}, 1)
+
+// ライドの決済に使う冪等キー。ライドの作成時に rides に保存する
+func paymentIdempotencyKey(rideID string) string {
+	return rideID
+}
+
+// 決済をアウトボックスに積む。ライドを COMPLETED にするのと同じトランザクションで呼ぶこと
+func enqueuePayment(tx2 *sqlx.Tx, ride *Ride, token string, amount int) error {
+	idempotencyKey := ride.PaymentIdempotencyKey
+	if idempotencyKey == "" {
+		idempotencyKey = paymentIdempotencyKey(ride.ID)
+	}
+	_, err := tx2.Exec(
+		`INSERT INTO payments (id, ride_id, user_id, token, amount, idempotency_key) VALUES (?, ?, ?, ?, ?, ?)`,
+		ulid.Make().String(), ride.ID, ride.UserID, token, amount, idempotencyKey,
+	)
+	return err
+}
+
+// 見積もった運賃で与信を取る。拒否されたら次のトークンで取り直す
+// ゲートウェイを待つ間ロックを持たないよう、トランザクションの外で呼ぶ
+// 応答が分からなくても取り消せるよう、与信の冪等キーを PLACING で記録してから送る
+// 取れた与信は recordPaymentHold で HELD にし、できなかったら voidPaymentHold で取り消すこと
+func placePaymentHold(ride *Ride, tokens []PaymentToken, amount int) (*Payment, error) {
+	paymentGatewayURL, err := getPaymentGatewayURL()
+	if err != nil {
+		return nil, err
+	}
+	idempotencyKey := ride.PaymentIdempotencyKey
+	if idempotencyKey == "" {
+		idempotencyKey = paymentIdempotencyKey(ride.ID)
+	}
+	p := &Payment{
+		ID:             ulid.Make().String(),
+		RideID:         ride.ID,
+		UserID:         ride.UserID,
+		Amount:         amount,
+		IdempotencyKey: idempotencyKey,
+		Kind:           paymentKindCapture,
+		Status:         paymentStatusPlacing,
+	}
+
+	var lastErr error
+	for _, t := range tokens {
+		// 別の与信になるので、トークンごとに冪等キーを変える
+		p.Token = t.Token
+		p.HoldKey = sql.NullString{String: ulid.Make().String(), Valid: true}
+		if _, err := db2.Exec(
+			`INSERT INTO payments (id, ride_id, user_id, token, amount, idempotency_key, kind, hold_key, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			 ON DUPLICATE KEY UPDATE token = VALUES(token), hold_key = VALUES(hold_key)`,
+			p.ID, p.RideID, p.UserID, p.Token, p.Amount, p.IdempotencyKey, p.Kind, p.HoldKey, p.Status,
+		); err != nil {
+			return nil, err
+		}
+		if err := requestPaymentGatewayPostHold(paymentGatewayURL, t.Token, p.HoldKey.String, &paymentGatewayPostHoldRequest{Amount: amount}); err != nil {
+			var rejected *paymentRejectedError
+			if !errors.As(err, &rejected) {
+				// 与信が取れたか分からないので取り消しておく
+				voidPaymentHold(p)
+				return nil, err
+			}
+			slog.Warn("payment hold declined", "ride_id", ride.ID, "err", rejected)
+			lastErr = err
+			continue
+		}
+		return p, nil
+	}
+	// どの与信も断られたので、取り消すものは無い
+	if _, err := db2.Exec(`DELETE FROM payments WHERE id = ? AND status = ?`, p.ID, paymentStatusPlacing); err != nil {
+		slog.Error("failed to delete declined payment hold", "ride_id", ride.ID, "err", err)
+	}
+	return nil, lastErr
+}
+
+// 取った与信を HELD にする。ライドを作るのと同じトランザクションで呼ぶこと
+// リコンサイラが先に取り消しを積んでいたら、ライドを作らずにエラーを返す
+func recordPaymentHold(tx2 *sqlx.Tx, p *Payment) error {
+	result, err := tx2.Exec(
+		`UPDATE payments SET status = ? WHERE id = ? AND status = ?`,
+		paymentStatusHeld, p.ID, paymentStatusPlacing,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("payment hold is no longer placing: payment_id=%s", p.ID)
+	}
+	return nil
+}
+
+// 記録できなかった与信を取り消すようアウトボックスに積む
+// 積めなくても PLACING のまま残るので、リコンサイラが後で取り消す
+func voidPaymentHold(p *Payment) {
+	if _, err := db2.Exec(
+		`UPDATE payments SET kind = ?, status = ? WHERE id = ? AND status = ?`,
+		paymentKindVoid, paymentStatusPending, p.ID, paymentStatusPlacing,
+	); err != nil {
+		slog.Error("failed to void payment hold", "ride_id", p.RideID, "hold_key", p.HoldKey.String, "err", err)
+		return
+	}
+	wakePaymentWorkers()
+}
+
+// 与信より高い運賃を確定しようとしたときのエラー
+var errFareExceedsHold = errors.New("fare exceeds the payment hold")
+
+// 与信を取ってあれば、運賃で確定するようアウトボックスに積む。与信が無ければ false を返す
+// 与信より高くは確定できないので、運賃が与信額を超えていたら確定せずに errFareExceedsHold を返す
+func capturePaymentHold(tx2 *sqlx.Tx, rideID string, amount int) (bool, error) {
+	var held int
+	if err := tx2.Get(&held, `SELECT amount FROM payments WHERE ride_id = ? AND status = ? FOR UPDATE`, rideID, paymentStatusHeld); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	if amount > held {
+		return false, fmt.Errorf("%w: ride_id=%s fare=%d hold=%d", errFareExceedsHold, rideID, amount, held)
+	}
+	if _, err := tx2.Exec(
+		`UPDATE payments SET status = ?, amount = ? WHERE ride_id = ? AND status = ?`,
+		paymentStatusPending, amount, rideID, paymentStatusHeld,
+	); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// 与信を取ってあれば、取り消すようアウトボックスに積む
+func cancelPaymentHold(tx2 *sqlx.Tx, rideID string) (bool, error) {
+	result, err := tx2.Exec(
+		`UPDATE payments SET kind = ?, status = ? WHERE ride_id = ? AND status = ?`,
+		paymentKindVoid, paymentStatusPending, rideID, paymentStatusHeld,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// 決済を積んで完了したライドであれば、完了した日時を返す
+// ゲートウェイに拒否された決済は完了とみなさない
+func previousRideCompletion(tx2 *sqlx.Tx, rideID string) (time.Time, bool, error) {
+	var status string
+	if err := tx2.Get(&status, `SELECT status FROM payments WHERE ride_id = ? AND kind <> ? AND status <> ?`, rideID, paymentKindVoid, paymentStatusHeld); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return time.Time{}, false, nil
+		}
+		return time.Time{}, false, err
+	}
+	if status == paymentStatusFailed {
+		return time.Time{}, false, nil
+	}
+	// 評価と同時に rides を更新しているので、その日時が完了日時になる
+	// 先に評価したリクエストのコミットを読むため、トランザクションの外で読む
+	var completedAt time.Time
+	if err := db.Get(&completedAt, `SELECT updated_at FROM rides WHERE id = ?`, rideID); err != nil {
+		return time.Time{}, false, err
+	}
+	return completedAt, true, nil
+}
+
+// コミット後に呼ぶと、ポーリングを待たずにワーカーが送信する
+func wakePaymentWorkers() {
+	select {
+	case paymentDoorbell <- struct{}{}:
+	default:
+	}
+}
+
+func startPaymentWorkers() {
+	for i := 0; i < paymentWorkers; i++ {
+		go paymentWorker()
+	}
+	go paymentReconciler()
+}
+
+func paymentWorker() {
+	ticker := time.NewTicker(paymentPollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			delivered, err := deliverNextPayment()
+			if err != nil {
+				slog.Error("failed to deliver payment", "err", err)
+				break
+			}
+			if !delivered {
+				break
+			}
+		}
+		select {
+		case <-paymentDoorbell:
+		case <-ticker.C:
+		}
+	}
+}
+
+// PENDING の決済を1件送る。送るものが無ければ false を返す
+func deliverNextPayment() (bool, error) {
+	// サーキットが開いている間は送らずに待つ
+	if checkPaymentGateway() != nil {
+		return false, nil
+	}
+	paymentGatewayURL, err := getPaymentGatewayURL()
+	if err != nil {
+		return false, err
+	}
+
+	p, err := claimPayment()
+	if err != nil || p == nil {
+		return false, err
+	}
+
+	status := paymentStatusSucceeded
+	var lastError sql.NullString
+	if err := sendPayment(paymentGatewayURL, p); err != nil {
+		lastError = sql.NullString{String: err.Error(), Valid: true}
+		var rejected *paymentRejectedError
+		if errors.As(err, &rejected) {
+			next, err := fallbackPaymentToken(p)
+			if err != nil {
+				return true, err
+			}
+			if next != nil {
+				// 次のトークンで決済し直す。別の決済になるので冪等キーも変える
+				slog.Warn("payment declined, falling back to the next payment method", "payment_id", p.ID, "ride_id", p.RideID, "kind", p.Kind, "err", rejected)
+				_, err := db2.Exec(
+					`UPDATE payments SET kind = ?, status = ?, token = ?, idempotency_key = ?, last_error = ? WHERE id = ? AND status = ?`,
+					paymentKindCharge, paymentStatusPending, next.Token, ulid.Make().String(), lastError, p.ID, paymentStatusUnknown,
+				)
+				if err == nil {
+					wakePaymentWorkers()
+				}
+				return true, err
+			}
+			status = paymentStatusFailed
+			slog.Error("payment rejected", "payment_id", p.ID, "ride_id", p.RideID, "kind", p.Kind, "err", err)
+		} else {
+			// 決済されたか分からないので UNKNOWN のままリコンサイラに任せる
+			status = paymentStatusUnknown
+			slog.Warn("payment outcome unknown", "payment_id", p.ID, "ride_id", p.RideID, "kind", p.Kind, "err", err)
+		}
+	}
+
+	if _, err := db2.Exec(
+		`UPDATE payments SET status = ?, last_error = ? WHERE id = ? AND status = ?`,
+		status, lastError, p.ID, paymentStatusUnknown,
+	); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+func sendPayment(paymentGatewayURL string, p *Payment) error {
+	switch p.Kind {
+	case paymentKindCapture:
+		return requestPaymentGatewayPostCapture(paymentGatewayURL, p.Token, p.HoldKey.String, p.IdempotencyKey, &paymentGatewayPostCaptureRequest{Amount: p.Amount})
+	case paymentKindVoid:
+		return requestPaymentGatewayPostVoid(paymentGatewayURL, p.Token, p.HoldKey.String)
+	default:
+		return requestPaymentGatewayPostPayment(paymentGatewayURL, p.Token, p.IdempotencyKey, &paymentGatewayPostPaymentRequest{Amount: p.Amount})
+	}
+}
+
+// 拒否された決済を送り直すトークンを返す。無ければ nil
+// 与信の確定が拒否されたら (与信の期限切れなど)、デフォルトのトークンから決済し直す
+// 与信の取り消しは送り直さない
+func fallbackPaymentToken(p *Payment) (*PaymentToken, error) {
+	switch p.Kind {
+	case paymentKindCapture:
+		tokens, err := getPaymentTokens(db, p.UserID)
+		if err != nil || len(tokens) == 0 {
+			return nil, err
+		}
+		return &tokens[0], nil
+	case paymentKindVoid:
+		return nil, nil
+	default:
+		return nextPaymentToken(p.UserID, p.Token)
+	}
+}
+
+// 送信する決済を1件選び、UNKNOWN にしてから返す
+// 送信中に落ちても、リコンサイラが同じ冪等キーで送り直すので二重にならない
+func claimPayment() (*Payment, error) {
+	tx2, err := db2.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx2.Rollback()
+
+	p := &Payment{}
+	if err := tx2.Get(
+		p,
+		`SELECT * FROM payments WHERE status = ? AND next_attempt_at <= NOW(6) ORDER BY created_at LIMIT 1 FOR UPDATE SKIP LOCKED`,
+		paymentStatusPending,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if _, err := tx2.Exec(
+		`UPDATE payments SET status = ?, attempts = attempts + 1, updated_at = NOW(6) WHERE id = ?`,
+		paymentStatusUnknown, p.ID,
+	); err != nil {
+		return nil, err
+	}
+	if err := tx2.Commit(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func paymentReconciler() {
+	ticker := time.NewTicker(paymentReconcileInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := reconcilePayments(); err != nil {
+			slog.Error("failed to reconcile payments", "err", err)
+		}
+	}
+}
+
+// 応答が返ってこないまま paymentInFlightTimeout を過ぎた UNKNOWN の決済を、同じ冪等キーで送り直す
+// PLACING のまま残った与信は取り消す
+// ゲートウェイは同じ冪等キーの再送を記録せずに成功を返すので、決済されたかを確かめずに送り直してよい
+// paymentMaxAttempts 回送っても分からなければ ABANDONED にして、ログに残す
+func reconcilePayments() error {
+	tx2, err := db2.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx2.Rollback()
+
+	// 与信を取りに行ったまま記録されなかったもの (プロセスが落ちたなど) は取り消す
+	voided, err := tx2.Exec(
+		`UPDATE payments SET kind = ?, status = ? WHERE status = ? AND updated_at < NOW(6) - INTERVAL ? MICROSECOND`,
+		paymentKindVoid, paymentStatusPending, paymentStatusPlacing, paymentInFlightTimeout.Microseconds(),
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := voided.RowsAffected(); err == nil && n > 0 {
+		slog.Warn("voiding payment holds left placing", "count", n)
+	}
+
+	payments := []Payment{}
+	if err := tx2.Select(
+		&payments,
+		`SELECT * FROM payments WHERE status = ? AND updated_at < NOW(6) - INTERVAL ? MICROSECOND ORDER BY created_at FOR UPDATE SKIP LOCKED`,
+		paymentStatusUnknown, paymentInFlightTimeout.Microseconds(),
+	); err != nil {
+		return err
+	}
+
+	for _, p := range payments {
+		if p.Attempts >= paymentMaxAttempts {
+			slog.Error("abandoned payment whose outcome is still unknown", "payment_id", p.ID, "ride_id", p.RideID, "kind", p.Kind, "idempotency_key", p.IdempotencyKey, "attempts", p.Attempts, "last_error", p.LastError.String)
+			if _, err := tx2.Exec(`UPDATE payments SET status = ? WHERE id = ?`, paymentStatusAbandoned, p.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := tx2.Exec(
+			`UPDATE payments SET status = ?, next_attempt_at = NOW(6) + INTERVAL ? MICROSECOND WHERE id = ?`,
+			paymentStatusPending, paymentRetryBackoff(p.Attempts).Microseconds(), p.ID,
+		); err != nil {
+			return err
+		}
+	}
+
+	if err := tx2.Commit(); err != nil {
+		return err
+	}
+	wakePaymentWorkers()
+	return nil
+}
+
+func paymentRetryBackoff(attempts int) time.Duration {
+	return time.Duration(1<<min(attempts, 6)) * 100 * time.Millisecond
+}
+
+// ユーザーの決済トークンを使う順 (デフォルト、登録順) に返す
+func getPaymentTokens(tx executableSelect, userID string) ([]PaymentToken, error) {
+	tokens := []PaymentToken{}
+	if err := tx.Select(&tokens, `SELECT * FROM payment_tokens WHERE user_id = ? ORDER BY is_default DESC, id`, userID); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// デフォルトが1つだけになるよう、ユーザーの決済トークンをまとめてロックして返す
+func lockPaymentTokens(tx *sqlx.Tx, userID string) ([]PaymentToken, error) {
+	tokens := []PaymentToken{}
+	if err := tx.Select(&tokens, `SELECT * FROM payment_tokens WHERE user_id = ? ORDER BY is_default DESC, id FOR UPDATE`, userID); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// token が拒否されたときに次に使うトークンを返す。無ければ nil
+func nextPaymentToken(userID string, token string) (*PaymentToken, error) {
+	tokens, err := getPaymentTokens(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	for i, t := range tokens {
+		if t.Token == token && i+1 < len(tokens) {
+			return &tokens[i+1], nil
+		}
+	}
+	return nil, nil
+}
+
+func maskPaymentToken(token string) string {
+	const visible = 4
+	if len(token) <= visible {
+		return strings.Repeat("*", len(token))
+	}
+	return strings.Repeat("*", len(token)-visible) + token[len(token)-visible:]
+}
@@ -0,0 +1,20 @@
+// Package pricing はライドの運賃計算を提供する
+// アプリ本体とオフラインのシミュレータ(cmd/matchsim)で同じ計算を使うために切り出している
+package pricing
+
+const (
+	InitialFare     = 500
+	FarePerDistance = 100
+	// サージの掛かっていない倍率 (%)
+	NoSurge = 100
+)
+
+// 移動距離に対する割引前の運賃 (Default のルール)
+func Fare(distance int) int {
+	return Default.Fare(distance, "", NoSurge)
+}
+
+// 移動距離に対する割引後の運賃 (Default のルール)。割引は初乗り運賃には適用しない
+func DiscountedFare(distance, discount int) int {
+	return Default.DiscountedFare(distance, "", NoSurge, discount)
+}
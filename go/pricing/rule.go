@@ -0,0 +1,81 @@
+package pricing
+
+import (
+	"cmp"
+	"slices"
+	"time"
+)
+
+// Rule は運賃の決め方。一度作ったら変更せず、変えるときは新しいバージョンを作る
+// ライドには見積もったときのバージョンを記録し、履歴や売上はそのバージョンで計算し直す
+type Rule struct {
+	Version       int
+	EffectiveFrom time.Time
+	InitialFare   int
+	// 最初の段階の距離あたりの運賃
+	FarePerDistance int
+	// これより安くはしない (割引前)
+	MinimumFare int
+	// 距離の段階ごとの運賃。FromDistance を超えた分から FarePerDistance を使う
+	DistanceTiers []DistanceTier
+	// 椅子モデルごとの倍率 (%)。無いモデルは100%
+	ModelMultipliers map[string]int
+}
+
+type DistanceTier struct {
+	FromDistance    int
+	FarePerDistance int
+}
+
+// Default はルールが登録されていないときに使う、従来どおりの運賃
+var Default = Rule{
+	Version:         1,
+	InitialFare:     InitialFare,
+	FarePerDistance: FarePerDistance,
+}
+
+// 距離に応じた運賃。段階ごとに距離あたりの運賃を変える
+func (r *Rule) metered(distance int) int {
+	tiers := slices.SortedFunc(slices.Values(r.DistanceTiers), func(a, b DistanceTier) int {
+		return cmp.Compare(a.FromDistance, b.FromDistance)
+	})
+	fare := 0
+	from, perDistance := 0, r.FarePerDistance
+	for _, tier := range tiers {
+		if distance <= tier.FromDistance {
+			break
+		}
+		fare += perDistance * (tier.FromDistance - from)
+		from, perDistance = tier.FromDistance, tier.FarePerDistance
+	}
+	return fare + perDistance*(distance-from)
+}
+
+func (r *Rule) multiplier(model string) int {
+	if m, ok := r.ModelMultipliers[model]; ok {
+		return m
+	}
+	return 100
+}
+
+// 割引前の運賃。椅子が決まる前は model を空にする。surge はサージの倍率 (%)
+func (r *Rule) Fare(distance int, model string, surge int) int {
+	m := r.multiplier(model) * surge / 100
+	return max((r.InitialFare+r.metered(distance))*m/100, r.MinimumFare)
+}
+
+// 割引後の運賃。割引は初乗り運賃には適用しない
+func (r *Rule) DiscountedFare(distance int, model string, surge int, discount int) int {
+	fare := r.Fare(distance, model, surge)
+	initialFare := r.InitialFare * (r.multiplier(model) * surge / 100) / 100
+	return fare - min(max(discount, 0), max(fare-initialFare, 0))
+}
+
+// 椅子が決まる前に与信を取る額。どのモデルが割り当てられても足りるよう、一番高い倍率で計算する
+func (r *Rule) HoldFare(distance int, surge int, discount int) int {
+	fare := r.DiscountedFare(distance, "", surge, discount)
+	for model := range r.ModelMultipliers {
+		fare = max(fare, r.DiscountedFare(distance, model, surge, discount))
+	}
+	return fare
+}
@@ -0,0 +1,124 @@
+package pricing
+
+import "testing"
+
+// 距離30まで100、30から50まで80、50から60
+var tiered = Rule{
+	Version:         2,
+	InitialFare:     500,
+	FarePerDistance: 100,
+	MinimumFare:     1000,
+	DistanceTiers: []DistanceTier{
+		{FromDistance: 50, FarePerDistance: 60},
+		{FromDistance: 30, FarePerDistance: 80},
+	},
+	ModelMultipliers: map[string]int{"fast": 150, "slow": 80},
+}
+
+func TestRuleMetered(t *testing.T) {
+	tests := []struct {
+		distance int
+		want     int
+	}{
+		{0, 0},
+		{1, 100},
+		{30, 3000},
+		{31, 3000 + 80},
+		{50, 3000 + 1600},
+		{51, 3000 + 1600 + 60},
+		{100, 3000 + 1600 + 3000},
+	}
+	for _, tt := range tests {
+		if got := tiered.metered(tt.distance); got != tt.want {
+			t.Errorf("metered(%d) = %d, want %d", tt.distance, got, tt.want)
+		}
+	}
+}
+
+func TestRuleFare(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     Rule
+		distance int
+		model    string
+		surge    int
+		want     int
+	}{
+		{name: "default", rule: Default, distance: 10, surge: NoSurge, want: 1500},
+		{name: "default zero distance", rule: Default, distance: 0, surge: NoSurge, want: 500},
+		{name: "minimum fare", rule: tiered, distance: 2, surge: NoSurge, want: 1000},
+		{name: "above minimum", rule: tiered, distance: 10, surge: NoSurge, want: 1500},
+		{name: "model multiplier", rule: tiered, distance: 10, model: "fast", surge: NoSurge, want: 2250},
+		{name: "unknown model", rule: tiered, distance: 10, model: "other", surge: NoSurge, want: 1500},
+		{name: "surge", rule: tiered, distance: 10, surge: 200, want: 3000},
+		{name: "model and surge", rule: tiered, distance: 10, model: "slow", surge: 150, want: 1800},
+		// 倍率を掛けた後でも最低運賃より安くしない
+		{name: "minimum after multiplier", rule: tiered, distance: 6, model: "slow", surge: NoSurge, want: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.Fare(tt.distance, tt.model, tt.surge); got != tt.want {
+				t.Errorf("Fare(%d, %q, %d) = %d, want %d", tt.distance, tt.model, tt.surge, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleDiscountedFare(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     Rule
+		distance int
+		model    string
+		surge    int
+		discount int
+		want     int
+	}{
+		{name: "no discount", rule: Default, distance: 10, surge: NoSurge, discount: 0, want: 1500},
+		{name: "partial discount", rule: Default, distance: 10, surge: NoSurge, discount: 300, want: 1200},
+		// 初乗り運賃は割り引かない
+		{name: "discount larger than metered", rule: Default, distance: 10, surge: NoSurge, discount: 3000, want: 500},
+		{name: "zero distance", rule: Default, distance: 0, surge: NoSurge, discount: 3000, want: 500},
+		{name: "negative discount", rule: Default, distance: 10, surge: NoSurge, discount: -100, want: 1500},
+		// 初乗り運賃にも倍率が掛かる
+		{name: "initial fare with multiplier", rule: tiered, distance: 10, model: "fast", surge: NoSurge, discount: 5000, want: 750},
+		{name: "initial fare with surge", rule: tiered, distance: 10, surge: 200, discount: 5000, want: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.DiscountedFare(tt.distance, tt.model, tt.surge, tt.discount); got != tt.want {
+				t.Errorf("DiscountedFare(%d, %q, %d, %d) = %d, want %d", tt.distance, tt.model, tt.surge, tt.discount, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleHoldFare(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     Rule
+		distance int
+		surge    int
+		discount int
+		want     int
+	}{
+		{name: "no multipliers", rule: Default, distance: 10, surge: NoSurge, want: 1500},
+		{name: "highest multiplier", rule: tiered, distance: 10, surge: NoSurge, want: 2250},
+		{name: "highest multiplier with discount", rule: tiered, distance: 10, surge: NoSurge, discount: 500, want: 1750},
+		{name: "highest multiplier with surge", rule: tiered, distance: 10, surge: 200, want: 4500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.rule.HoldFare(tt.distance, tt.surge, tt.discount)
+			if got != tt.want {
+				t.Errorf("HoldFare(%d, %d, %d) = %d, want %d", tt.distance, tt.surge, tt.discount, got, tt.want)
+			}
+			// どのモデルが割り当てられても与信で足りる
+			for _, model := range []string{"", "fast", "slow", "other"} {
+				if fare := tt.rule.DiscountedFare(tt.distance, model, tt.surge, tt.discount); fare > got {
+					t.Errorf("DiscountedFare for %q = %d exceeds hold %d", model, fare, got)
+				}
+			}
+		})
+	}
+}
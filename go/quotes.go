@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// 見積もりで返す運賃の見積もりID
+// 見積もりの内容をそのまま署名して返すので、見積もりの時点ではサーバーに何も保存しない
+// ライドの作成で見積もりIDを渡すと、見積もったときのルール・サージ・クーポンで運賃を決める
+// 使った見積もりは rides.quote_id に記録し、同じ見積もりで2回配車しない
+
+// 見積もりIDの有効期間
+const quoteTTL = 2 * time.Minute
+
+var (
+	errQuoteInvalid = errors.New("invalid quote_id")
+	errQuoteExpired = errors.New("quote has expired, please estimate the fare again")
+	errQuoteUsed    = errors.New("quote has already been used, please estimate the fare again")
+)
+
+var quoteSecret []byte
+
+// ISUCON_QUOTE_SECRET を読む。複数のホストで見積もりIDを検証するなら同じ値を設定すること
+func loadQuoteSecret() []byte {
+	if v := os.Getenv("ISUCON_QUOTE_SECRET"); v != "" {
+		return []byte(v)
+	}
+	slog.Warn("ISUCON_QUOTE_SECRET is not set, quotes are only valid on this process")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+type fareQuote struct {
+	// 見積もりごとに振るID。rides.quote_id に記録する
+	ID              string     `json:"id"`
+	UserID          string     `json:"user_id"`
+	Pickup          Coordinate `json:"pickup"`
+	Destination     Coordinate `json:"destination"`
+	FareRuleVersion int        `json:"fare_rule_version"`
+	SurgePercent    int        `json:"surge_percent"`
+	// 見積もりで使ったクーポン。無ければ空
+	CouponCode string `json:"coupon_code,omitempty"`
+	// 割引後の運賃
+	Fare      int   `json:"fare"`
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+func quoteSignature(payload string) string {
+	mac := hmac.New(sha256.New, quoteSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signQuote(q *fareQuote) (string, error) {
+	b, err := json.Marshal(q)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + quoteSignature(payload), nil
+}
+
+// 署名と有効期限を確かめて見積もりを取り出す
+func verifyQuote(id string, now time.Time) (*fareQuote, error) {
+	payload, signature, ok := strings.Cut(id, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(quoteSignature(payload))) {
+		return nil, errQuoteInvalid
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errQuoteInvalid
+	}
+	q := &fareQuote{}
+	if err := json.Unmarshal(b, q); err != nil || q.ID == "" {
+		return nil, errQuoteInvalid
+	}
+	if now.UnixMilli() > q.ExpiresAt {
+		return nil, errQuoteExpired
+	}
+	return q, nil
+}
+
+// 見積もりが、このユーザーのこの区間のものか
+func (q *fareQuote) matches(userID string, pickup, destination Coordinate) bool {
+	return q.UserID == userID && q.Pickup == pickup && q.Destination == destination
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// 返金はオペレーターが完了済みのライドに対して行う
+// PENDING で記録してから送り、ゲートウェイの応答が分からなかったものは次に返金するときに同じ冪等キーで送り直す
+const (
+	refundStatusPending   = "PENDING"
+	refundStatusSucceeded = "SUCCEEDED"
+	refundStatusFailed    = "FAILED"
+)
+
+type internalPostRideRefundRequest struct {
+	// 省略したら返金されていない分をすべて返金する
+	Amount *int   `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+type internalPostRideRefundResponse struct {
+	RefundID string `json:"refund_id"`
+	RideID   string `json:"ride_id"`
+	Amount   int    `json:"amount"`
+	Status   string `json:"status"`
+	// このライドで返金済みの合計
+	RefundedAmount int `json:"refunded_amount"`
+	// 決済額
+	PaymentAmount int `json:"payment_amount"`
+}
+
+func internalPostRideRefund(w http.ResponseWriter, r *http.Request) {
+	rideID := r.PathValue("ride_id")
+
+	req := &internalPostRideRefundRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Reason == "" {
+		writeError(w, http.StatusBadRequest, errors.New("reason is required"))
+		return
+	}
+
+	// 応答が分からなかった返金を先に送り直す。PENDING のままだと返金できる残りが減ったままになる
+	pending := &Payment{}
+	if err := db2.Get(pending, `SELECT * FROM payments WHERE ride_id = ?`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("payment for the ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if _, err := deliverPendingRefunds(pending); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	tx2, err := db2.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx2.Rollback()
+
+	// 同じライドの返金が同時に来ても返金しすぎないよう、決済の行をロックする
+	payment := &Payment{}
+	if err := tx2.Get(payment, `SELECT * FROM payments WHERE ride_id = ? FOR UPDATE`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("payment for the ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if payment.Status != paymentStatusSucceeded {
+		writeError(w, http.StatusConflict, fmt.Errorf("payment is not settled: status=%s", payment.Status))
+		return
+	}
+
+	var refunded int
+	if err := tx2.Get(
+		&refunded,
+		`SELECT IFNULL(SUM(amount), 0) FROM refunds WHERE payment_id = ? AND status IN (?, ?)`,
+		payment.ID, refundStatusPending, refundStatusSucceeded,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	remaining := payment.Amount - refunded
+	amount := remaining
+	if req.Amount != nil {
+		amount = *req.Amount
+	}
+	if amount <= 0 || amount > remaining {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("amount must be between 1 and %d", remaining))
+		return
+	}
+
+	refund := &Refund{
+		ID:             ulid.Make().String(),
+		RideID:         rideID,
+		PaymentID:      payment.ID,
+		Amount:         amount,
+		Reason:         req.Reason,
+		IdempotencyKey: ulid.Make().String(),
+		Status:         refundStatusPending,
+	}
+	if _, err := tx2.Exec(
+		`INSERT INTO refunds (id, ride_id, payment_id, amount, reason, idempotency_key) VALUES (?, ?, ?, ?, ?, ?)`,
+		refund.ID, refund.RideID, refund.PaymentID, refund.Amount, refund.Reason, refund.IdempotencyKey,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx2.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	statuses, err := deliverPendingRefunds(payment)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	refund.Status = statuses[refund.ID]
+
+	if err := db2.Get(
+		&refunded,
+		`SELECT IFNULL(SUM(amount), 0) FROM refunds WHERE payment_id = ? AND status = ?`,
+		payment.ID, refundStatusSucceeded,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	statusCode := http.StatusOK
+	switch refund.Status {
+	case refundStatusFailed:
+		statusCode = http.StatusBadRequest
+	case refundStatusPending:
+		// 返金されたか分からない。次に返金するときに送り直す
+		statusCode = http.StatusBadGateway
+	}
+	writeJSON(w, statusCode, &internalPostRideRefundResponse{
+		RefundID:       refund.ID,
+		RideID:         refund.RideID,
+		Amount:         refund.Amount,
+		Status:         refund.Status,
+		RefundedAmount: refunded,
+		PaymentAmount:  payment.Amount,
+	})
+}
+
+// 決済の PENDING な返金を古い順に送り、返金IDごとの送信後の状態を返す
+func deliverPendingRefunds(payment *Payment) (map[string]string, error) {
+	paymentGatewayURL, err := getPaymentGatewayURL()
+	if err != nil {
+		return nil, err
+	}
+
+	refunds := []Refund{}
+	if err := db2.Select(
+		&refunds,
+		`SELECT * FROM refunds WHERE payment_id = ? AND status = ? ORDER BY created_at`,
+		payment.ID, refundStatusPending,
+	); err != nil {
+		return nil, err
+	}
+
+	statuses := make(map[string]string, len(refunds))
+	refunded := false
+	for _, refund := range refunds {
+		status := refundStatusSucceeded
+		var lastError sql.NullString
+		if err := requestPaymentGatewayPostRefund(
+			paymentGatewayURL, payment.Token, payment.IdempotencyKey, refund.IdempotencyKey,
+			&paymentGatewayPostRefundRequest{Amount: refund.Amount},
+		); err != nil {
+			lastError = sql.NullString{String: err.Error(), Valid: true}
+			var rejected *paymentRejectedError
+			if errors.As(err, &rejected) {
+				status = refundStatusFailed
+				slog.Error("refund rejected", "refund_id", refund.ID, "ride_id", refund.RideID, "err", err)
+			} else {
+				status = refundStatusPending
+				slog.Warn("refund outcome unknown", "refund_id", refund.ID, "ride_id", refund.RideID, "err", err)
+			}
+		}
+		if _, err := db2.Exec(
+			`UPDATE refunds SET status = ?, last_error = ? WHERE id = ? AND status = ?`,
+			status, lastError, refund.ID, refundStatusPending,
+		); err != nil {
+			return nil, err
+		}
+		statuses[refund.ID] = status
+		refunded = refunded || status == refundStatusSucceeded
+	}
+	if refunded {
+		if err := refreshRideSale(payment.RideID); err != nil {
+			return nil, err
+		}
+	}
+	return statuses, nil
+}
+
+// 返金が成功したら、売上から返金分を差し引いて記録し直す。完了日時は変えない
+func refreshRideSale(rideID string) error {
+	ride := &Ride{}
+	if err := db.Get(ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
+		return err
+	}
+	sale, err := rideSale(ride)
+	if err != nil {
+		return err
+	}
+	refunds, err := getRideRefunds(db2, []string{rideID})
+	if err != nil {
+		return err
+	}
+	if rf, ok := refunds[rideID]; ok {
+		sale = rf.netSale(sale)
+	}
+	_, err = db.Exec(`UPDATE rides SET sale = ?, updated_at = updated_at WHERE id = ?`, sale, rideID)
+	return err
+}
+
+// 返金のあったライドの決済額と返金済みの合計
+type rideRefund struct {
+	RideID   string `db:"ride_id"`
+	Amount   int    `db:"amount"`
+	Refunded int    `db:"refunded"`
+}
+
+// 売上から返金分を差し引く
+// 決済額はクーポンで割り引かれているので、差額ではなく返金した割合だけ売上を減らす
+func (rf rideRefund) netSale(sale int) int {
+	if rf.Amount <= 0 {
+		return sale
+	}
+	return sale - sale*min(rf.Refunded, rf.Amount)/rf.Amount
+}
+
+// ライドごとの返金済みの合計を返す。返金の無いライドは含まない
+func getRideRefunds(tx executableSelect, rideIDs []string) (map[string]rideRefund, error) {
+	refunds := map[string]rideRefund{}
+	if len(rideIDs) == 0 {
+		return refunds, nil
+	}
+	query, args, err := sqlx.In(
+		`SELECT payments.ride_id, payments.amount, SUM(refunds.amount) AS refunded
+		 FROM refunds JOIN payments ON payments.id = refunds.payment_id
+		 WHERE refunds.ride_id IN (?) AND refunds.status = ?
+		 GROUP BY payments.ride_id, payments.amount`,
+		rideIDs, refundStatusSucceeded,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rows := []rideRefund{}
+	if err := tx.Select(&rows, query, args...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		refunds[row.RideID] = row
+	}
+	return refunds, nil
+}
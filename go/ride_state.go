@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ステータスを変更する主体
+type rideActor string
+
+const (
+	rideActorUser  rideActor = "user"
+	rideActorChair rideActor = "chair"
+	// 椅子が送った座標で配車位置・目的地への到着を確かめたとき
+	rideActorChairLocation rideActor = "chair_location"
+)
+
+type rideTransition struct {
+	From string
+	To   string
+	// この遷移を起こせる主体
+	By []rideActor
+	// 遷移後に通知する相手
+	NotifyUser  bool
+	NotifyChair bool
+}
+
+// RideStateMachine はライドのステータス遷移とその通知先を一箇所で定義する
+// ステータスを変えるハンドラは必ずこれを通す
+type RideStateMachine struct {
+	transitions map[string]map[string]rideTransition
+	// ステータスごとの通知先 (マッチング時のようにステータスを変えずに通知する場合にも使う)
+	notifyTargets map[string]rideTransition
+}
+
+var rideStateMachine = newRideStateMachine([]rideTransition{
+	{From: "", To: "MATCHING", By: []rideActor{rideActorUser}},
+	{From: "MATCHING", To: "ENROUTE", By: []rideActor{rideActorChair}, NotifyUser: true, NotifyChair: true},
+	{From: "ENROUTE", To: "PICKUP", By: []rideActor{rideActorChairLocation}, NotifyUser: true, NotifyChair: true},
+	{From: "PICKUP", To: "CARRYING", By: []rideActor{rideActorChair}, NotifyUser: true, NotifyChair: true},
+	{From: "CARRYING", To: "ARRIVED", By: []rideActor{rideActorChairLocation}, NotifyUser: true, NotifyChair: true},
+	{From: "ARRIVED", To: "COMPLETED", By: []rideActor{rideActorUser}, NotifyUser: true, NotifyChair: true},
+	// 乗車するまではどちらからでもキャンセルできる
+	{From: "MATCHING", To: "CANCELED", By: []rideActor{rideActorUser, rideActorChair}, NotifyUser: true, NotifyChair: true},
+	{From: "ENROUTE", To: "CANCELED", By: []rideActor{rideActorUser, rideActorChair}, NotifyUser: true, NotifyChair: true},
+	{From: "PICKUP", To: "CANCELED", By: []rideActor{rideActorUser, rideActorChair}, NotifyUser: true, NotifyChair: true},
+}, map[string]rideTransition{
+	// 椅子が割り当てられたときは MATCHING のまま両者に通知する
+	"MATCHING": {NotifyUser: true, NotifyChair: true},
+})
+
+func newRideStateMachine(transitions []rideTransition, notifyTargets map[string]rideTransition) *RideStateMachine {
+	m := &RideStateMachine{
+		transitions:   map[string]map[string]rideTransition{},
+		notifyTargets: map[string]rideTransition{},
+	}
+	for _, t := range transitions {
+		if m.transitions[t.From] == nil {
+			m.transitions[t.From] = map[string]rideTransition{}
+		}
+		m.transitions[t.From][t.To] = t
+		m.notifyTargets[t.To] = t
+	}
+	for status, t := range notifyTargets {
+		m.notifyTargets[status] = t
+	}
+	return m
+}
+
+// 許可されていない遷移を要求されたときのエラー
+type rideTransitionError struct {
+	RideID    string
+	Current   string
+	Requested string
+	By        rideActor
+	// 遷移自体はあるが、要求した主体には許可されていない
+	Forbidden bool
+}
+
+func (e *rideTransitionError) Error() string {
+	if e.Forbidden {
+		return fmt.Sprintf("%s is not allowed to change ride status to %s: ride_id=%s status=%s", e.By, e.Requested, e.RideID, e.Current)
+	}
+	return fmt.Sprintf("cannot change ride status from %s to %s: ride_id=%s", e.Current, e.Requested, e.RideID)
+}
+
+// TerminalStatuses はそこから先に遷移しないステータスを返す
+func (m *RideStateMachine) TerminalStatuses() []string {
+	statuses := []string{}
+	for status := range m.notifyTargets {
+		if len(m.transitions[status]) == 0 {
+			statuses = append(statuses, status)
+		}
+	}
+	slices.Sort(statuses)
+	return statuses
+}
+
+// Transition は現在のステータスを行ロックして読み、許可された遷移であれば to に変更する
+// 許可されていなければ *rideTransitionError を返す
+func (m *RideStateMachine) Transition(tx2 *sqlx.Tx, rideID string, to string, by rideActor) (*rideTransition, error) {
+	var current string
+	if err := tx2.Get(&current, `SELECT status FROM ride_status WHERE ride_id = ? FOR UPDATE`, rideID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	t, err := m.check(rideID, current, to, by)
+	if err != nil {
+		return nil, err
+	}
+	if err := setRideStatus(tx2, rideID, to); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// current から to への遷移を by が起こせるかを確かめる
+func (m *RideStateMachine) check(rideID string, current string, to string, by rideActor) (*rideTransition, error) {
+	t, ok := m.transitions[current][to]
+	if !ok {
+		return nil, &rideTransitionError{RideID: rideID, Current: current, Requested: to, By: by}
+	}
+	if !slices.Contains(t.By, by) {
+		return nil, &rideTransitionError{RideID: rideID, Current: current, Requested: to, By: by, Forbidden: true}
+	}
+	return &t, nil
+}
+
+// Notify は status に応じた相手にライドの状態を通知する。コミット後に呼ぶこと
+func (m *RideStateMachine) Notify(ride *Ride, status string) {
+	t := m.notifyTargets[status]
+	if t.NotifyChair && ride.ChairID.Valid {
+		sendNotificationSSE(ride.ChairID.String, ride, status)
+	}
+	if t.NotifyUser {
+		sendNotificationSSEApp(ride.UserID, ride, status)
+	}
+}
+
+// 遷移のエラーをレスポンスにする。許可されていない遷移なら、要求した主体に許可されていない場合も含めて現在のステータスを付けて409を返す
+func writeRideTransitionError(w http.ResponseWriter, err error) {
+	var te *rideTransitionError
+	if !errors.As(err, &te) {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	slog.Warn("application", "code", http.StatusConflict, "error", err)
+	writeJSON(w, http.StatusConflict, map[string]string{
+		"message":        te.Error(),
+		"current_status": te.Current,
+	})
+}
+
+// ライドをキャンセルする。ユーザー・椅子のキャンセルAPIから共通で使う
+// isParticipant が false のライドは存在しないものとして扱う
+func cancelRide(w http.ResponseWriter, rideID string, by rideActor, isParticipant func(ride *Ride) bool) {
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+	tx2, err := db2.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx2.Rollback()
+
+	// マッチングと競合しないよう行ロックを取る
+	ride := &Ride{}
+	if err := tx.Get(ride, `SELECT * FROM rides WHERE id = ? FOR UPDATE`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !isParticipant(ride) {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
+
+	if _, err := rideStateMachine.Transition(tx2, ride.ID, "CANCELED", by); err != nil {
+		writeRideTransitionError(w, err)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE rides SET canceled_at = NOW(6) WHERE id = ?`, ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// 使ったクーポンは未使用に戻す
+	if _, err := tx2.Exec(`UPDATE coupons SET used_by = NULL WHERE used_by = ?`, ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// 与信はコミット後にワーカーが取り消す
+	voided, err := cancelPaymentHold(tx2, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx2.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if voided {
+		wakePaymentWorkers()
+	}
+	rideCache.Delete(ride.ID)
+	if ride.ChairID.Valid {
+		if v, ok := chairsInRide.Load(ride.ChairID.String); ok && v.(*Ride).ID == ride.ID {
+			chairsInRide.Delete(ride.ChairID.String)
+		}
+	}
+	slog.Debug("ride canceled", "ride_id", ride.ID, "by", by)
+	rideStateMachine.Notify(ride, "CANCELED")
+
+	w.WriteHeader(http.StatusNoContent)
+}
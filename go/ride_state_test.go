@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestRideStateMachineCheck(t *testing.T) {
+	type result int
+	const (
+		allowed result = iota
+		// 遷移はあるがその主体には許可されていない
+		forbidden
+		// 遷移自体がない
+		invalid
+	)
+
+	cases := []struct {
+		from string
+		to   string
+		by   rideActor
+		want result
+	}{
+		{"", "MATCHING", rideActorUser, allowed},
+		{"", "MATCHING", rideActorChair, forbidden},
+		{"", "ENROUTE", rideActorChair, invalid},
+
+		{"MATCHING", "ENROUTE", rideActorChair, allowed},
+		{"MATCHING", "ENROUTE", rideActorUser, forbidden},
+		{"MATCHING", "PICKUP", rideActorChairLocation, invalid},
+
+		// 配車位置・目的地への到着は座標からしか起こせない
+		{"ENROUTE", "PICKUP", rideActorChairLocation, allowed},
+		{"ENROUTE", "PICKUP", rideActorChair, forbidden},
+		{"CARRYING", "ARRIVED", rideActorChairLocation, allowed},
+		{"CARRYING", "ARRIVED", rideActorChair, forbidden},
+
+		{"PICKUP", "CARRYING", rideActorChair, allowed},
+		{"PICKUP", "CARRYING", rideActorChairLocation, forbidden},
+		{"ENROUTE", "CARRYING", rideActorChair, invalid},
+
+		{"ARRIVED", "COMPLETED", rideActorUser, allowed},
+		{"ARRIVED", "COMPLETED", rideActorChair, forbidden},
+		{"CARRYING", "COMPLETED", rideActorUser, invalid},
+
+		// 乗車するまではどちらからでもキャンセルできる
+		{"MATCHING", "CANCELED", rideActorUser, allowed},
+		{"MATCHING", "CANCELED", rideActorChair, allowed},
+		{"ENROUTE", "CANCELED", rideActorUser, allowed},
+		{"PICKUP", "CANCELED", rideActorChair, allowed},
+		{"PICKUP", "CANCELED", rideActorChairLocation, forbidden},
+		{"CARRYING", "CANCELED", rideActorUser, invalid},
+		{"ARRIVED", "CANCELED", rideActorUser, invalid},
+
+		// 終わったライドはどこにも遷移しない
+		{"COMPLETED", "MATCHING", rideActorUser, invalid},
+		{"CANCELED", "MATCHING", rideActorUser, invalid},
+		{"CANCELED", "CANCELED", rideActorUser, invalid},
+	}
+	for _, c := range cases {
+		t.Run(c.from+"->"+c.to+"/"+string(c.by), func(t *testing.T) {
+			tr, err := rideStateMachine.check("ride", c.from, c.to, c.by)
+			var te *rideTransitionError
+			switch c.want {
+			case allowed:
+				if err != nil {
+					t.Fatalf("check() error = %v, want nil", err)
+				}
+				if tr.From != c.from || tr.To != c.to {
+					t.Errorf("check() = %s->%s, want %s->%s", tr.From, tr.To, c.from, c.to)
+				}
+			case forbidden, invalid:
+				if !errors.As(err, &te) {
+					t.Fatalf("check() error = %v, want *rideTransitionError", err)
+				}
+				if te.Forbidden != (c.want == forbidden) {
+					t.Errorf("Forbidden = %v, want %v", te.Forbidden, c.want == forbidden)
+				}
+				if te.Current != c.from || te.Requested != c.to {
+					t.Errorf("error has %s->%s, want %s->%s", te.Current, te.Requested, c.from, c.to)
+				}
+			}
+		})
+	}
+}
+
+func TestRideStateMachineTerminalStatuses(t *testing.T) {
+	want := []string{"CANCELED", "COMPLETED"}
+	if got := rideStateMachine.TerminalStatuses(); !slices.Equal(got, want) {
+		t.Errorf("TerminalStatuses() = %v, want %v", got, want)
+	}
+}
+
+func TestRideStateMachineNotifyTargets(t *testing.T) {
+	cases := []struct {
+		status      string
+		notifyUser  bool
+		notifyChair bool
+	}{
+		// ライドを作っただけではまだ誰にも通知しない
+		{"", false, false},
+		// 椅子が割り当てられたときは MATCHING のまま両者に通知する
+		{"MATCHING", true, true},
+		{"ENROUTE", true, true},
+		{"PICKUP", true, true},
+		{"CARRYING", true, true},
+		{"ARRIVED", true, true},
+		{"COMPLETED", true, true},
+		{"CANCELED", true, true},
+	}
+	for _, c := range cases {
+		got := rideStateMachine.notifyTargets[c.status]
+		if got.NotifyUser != c.notifyUser || got.NotifyChair != c.notifyChair {
+			t.Errorf("notifyTargets[%q] = user:%v chair:%v, want user:%v chair:%v",
+				c.status, got.NotifyUser, got.NotifyChair, c.notifyUser, c.notifyChair)
+		}
+	}
+}
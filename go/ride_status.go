@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type executableExec interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// ライドのステータスを変更する
+// 履歴は ride_status_events に追記し、現在の状態は ride_status の1行を書き換えるので
+// getLatestRideStatus は主キー1発で引ける
+func setRideStatus(tx executableExec, rideID string, status string) error {
+	now := time.Now()
+	if _, err := tx.Exec(
+		`INSERT INTO ride_status_events (ride_id, status, created_at) VALUES (?, ?, ?)`,
+		rideID, status, now,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO ride_status (ride_id, status, updated_at) VALUES (?, ?, ?)
+		 ON DUPLICATE KEY UPDATE status = VALUES(status), updated_at = VALUES(updated_at)`,
+		rideID, status, now,
+	); err != nil {
+		return err
+	}
+	return nil
+}
+
+func getLatestRideStatus(tx executableGet, rideID string) (string, error) {
+	var s string
+	if err := tx.Get(&s, `SELECT status FROM ride_status WHERE ride_id = ?`, rideID); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// ライドごとの今のステータス
+func getLatestRideStatuses(tx executableSelect, rideIDs []string) (map[string]string, error) {
+	statuses := make(map[string]string, len(rideIDs))
+	if len(rideIDs) == 0 {
+		return statuses, nil
+	}
+	query, args, err := sqlx.In(`SELECT ride_id, status FROM ride_status WHERE ride_id IN (?)`, rideIDs)
+	if err != nil {
+		return nil, err
+	}
+	rows := []struct {
+		RideID string `db:"ride_id"`
+		Status string `db:"status"`
+	}{}
+	if err := tx.Select(&rows, query, args...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		statuses[row.RideID] = row.Status
+	}
+	return statuses, nil
+}
+
+type executableSelect interface {
+	Select(dest interface{}, query string, args ...interface{}) error
+}
+
+// ライドのステータス変更履歴を古い順に返す
+func getRideStatusEvents(tx executableSelect, rideID string) ([]RideStatusEvent, error) {
+	events := []RideStatusEvent{}
+	if err := tx.Select(&events, `SELECT * FROM ride_status_events WHERE ride_id = ? ORDER BY id`, rideID); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
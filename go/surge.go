@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon14/webapp/go/matcher"
+	"github.com/isucon/isucon14/webapp/go/pricing"
+)
+
+// サージ料金
+// マッチングのたびにリーダーが、セルごとに待っているライドと空いている椅子の比から倍率を求めて surge_cells に保存する
+// マッチングごとに倍率が跳ねないよう、前回の倍率との指数移動平均でならし、上限で抑える
+
+// 倍率は10%刻みで見せる
+const surgeStepPercent = 10
+
+// 他のホストでマッチングした結果もこの間隔で読み直す
+const surgeRefreshInterval = 500 * time.Millisecond
+
+type surgeConfig struct {
+	// セルの一辺の長さ
+	CellSize int
+	// 倍率の上限。1以下ならサージを掛けない
+	Max float64
+	// 今回の需給をどれだけ反映するか (0〜1)。小さいほどゆっくり変わる
+	Smoothing float64
+}
+
+var surgeSettings = surgeConfig{CellSize: 50, Max: 1, Smoothing: 0.3}
+
+// ISUCON_SURGE_CELL_SIZE, ISUCON_SURGE_MAX, ISUCON_SURGE_SMOOTHING を読む
+func loadSurgeConfig() surgeConfig {
+	c := surgeSettings
+	if v := os.Getenv("ISUCON_SURGE_CELL_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			panic(fmt.Sprintf("invalid ISUCON_SURGE_CELL_SIZE environment variable: %q", v))
+		}
+		c.CellSize = n
+	}
+	if v := os.Getenv("ISUCON_SURGE_MAX"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			panic(fmt.Sprintf("failed to convert ISUCON_SURGE_MAX environment variable into float: %v", err))
+		}
+		c.Max = f
+	}
+	if v := os.Getenv("ISUCON_SURGE_SMOOTHING"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 || f > 1 {
+			panic(fmt.Sprintf("invalid ISUCON_SURGE_SMOOTHING environment variable: %q", v))
+		}
+		c.Smoothing = f
+	}
+	return c
+}
+
+type surgeCell struct {
+	Latitude  int `db:"cell_latitude"`
+	Longitude int `db:"cell_longitude"`
+}
+
+func surgeCellOf(latitude, longitude int) surgeCell {
+	size := surgeSettings.CellSize
+	return surgeCell{
+		Latitude:  int(math.Floor(float64(latitude) / float64(size))),
+		Longitude: int(math.Floor(float64(longitude) / float64(size))),
+	}
+}
+
+type surgeBoard struct {
+	mu       sync.Mutex
+	cells    map[surgeCell]float64
+	loadedAt time.Time
+}
+
+var surge = &surgeBoard{}
+
+func (b *surgeBoard) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cells = nil
+	b.loadedAt = time.Time{}
+}
+
+func (b *surgeBoard) load() (map[surgeCell]float64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cells != nil && time.Since(b.loadedAt) < surgeRefreshInterval {
+		return b.cells, nil
+	}
+	cells, err := loadSurgeCells()
+	if err != nil {
+		return nil, err
+	}
+	b.cells = cells
+	b.loadedAt = time.Now()
+	return cells, nil
+}
+
+func (b *surgeBoard) store(cells map[surgeCell]float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cells = cells
+	b.loadedAt = time.Now()
+}
+
+// 配車位置に掛かるサージの倍率 (%)
+func (b *surgeBoard) percent(latitude, longitude int) (int, error) {
+	if surgeSettings.Max <= 1 {
+		return pricing.NoSurge, nil
+	}
+	cells, err := b.load()
+	if err != nil {
+		return 0, err
+	}
+	m, ok := cells[surgeCellOf(latitude, longitude)]
+	if !ok {
+		return pricing.NoSurge, nil
+	}
+	p := int(math.Round(m*100/surgeStepPercent)) * surgeStepPercent
+	return min(max(p, pricing.NoSurge), int(surgeSettings.Max*100)), nil
+}
+
+func loadSurgeCells() (map[surgeCell]float64, error) {
+	rows := []struct {
+		surgeCell
+		Multiplier float64 `db:"multiplier"`
+	}{}
+	if err := db.Select(&rows, `SELECT cell_latitude, cell_longitude, multiplier FROM surge_cells`); err != nil {
+		return nil, err
+	}
+	cells := make(map[surgeCell]float64, len(rows))
+	for _, row := range rows {
+		cells[row.surgeCell] = row.Multiplier
+	}
+	return cells, nil
+}
+
+// マッチングの前の需給から倍率を更新する。マッチングのリーダーが呼ぶ
+// 待っているライドが空いている椅子(+1)より多いセルほど倍率を上げ、ライドが無くなったセルは1に戻していく
+func updateSurge(rides []*Ride, freeChairs []*matcher.Chair) error {
+	cfg := surgeSettings
+	if cfg.Max <= 1 {
+		return nil
+	}
+
+	prev, err := loadSurgeCells()
+	if err != nil {
+		return err
+	}
+	waiting := map[surgeCell]int{}
+	for _, ride := range rides {
+		waiting[surgeCellOf(ride.PickupLatitude, ride.PickupLongitude)]++
+	}
+	free := map[surgeCell]int{}
+	for _, chair := range freeChairs {
+		free[surgeCellOf(chair.Latitude, chair.Longitude)]++
+	}
+
+	next := make(map[surgeCell]float64, len(prev)+len(waiting))
+	update := func(cell surgeCell) {
+		if _, ok := next[cell]; ok {
+			return
+		}
+		old, ok := prev[cell]
+		if !ok {
+			old = 1
+		}
+		raw := min(max(float64(waiting[cell])/float64(free[cell]+1), 1), cfg.Max)
+		m := old + cfg.Smoothing*(raw-old)
+		if m < 1+0.5*surgeStepPercent/100.0 && raw <= 1 {
+			// 1に戻った
+			return
+		}
+		next[cell] = m
+	}
+	for cell := range prev {
+		update(cell)
+	}
+	for cell := range waiting {
+		update(cell)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM surge_cells`); err != nil {
+		return err
+	}
+	for cell, m := range next {
+		if _, err := tx.Exec(
+			`INSERT INTO surge_cells (cell_latitude, cell_longitude, multiplier) VALUES (?, ?, ?)`,
+			cell.Latitude, cell.Longitude, m,
+		); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	surge.store(next)
+	slog.Debug("surge updated", "cells", len(next))
+	return nil
+}
+
+func surgeMultiplier(percent int) float64 {
+	return float64(percent) / 100
+}
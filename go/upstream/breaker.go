@@ -0,0 +1,66 @@
+package upstream
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// サーキットが開いている間、リクエストを送らずに返すエラー
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreaker は失敗が続いたらしばらくリクエストを止める
+// Cooldown が過ぎたら1件だけ試しに通し、成功すれば閉じ、失敗すればまた Cooldown だけ止める
+type CircuitBreaker struct {
+	// 連続してこの回数失敗したら開く
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	// ゼロ値なら閉じている
+	openedAt time.Time
+	probing  bool
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+// Allow はリクエストを送ってよければ nil を、開いていれば ErrCircuitOpen を返す
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openedAt.IsZero() {
+		return nil
+	}
+	if b.probing || time.Since(b.openedAt) < b.Cooldown {
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// IsOpen はリクエストを止めている最中かを返す。Allow と違って試しのリクエストを消費しない
+func (b *CircuitBreaker) IsOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openedAt.IsZero() && (b.probing || time.Since(b.openedAt) < b.Cooldown)
+}
+
+// Record は Allow で通したリクエストの結果を記録する
+func (b *CircuitBreaker) Record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		b.failures = 0
+		b.openedAt = time.Time{}
+		b.probing = false
+		return
+	}
+	b.failures++
+	if b.probing || b.failures >= b.Threshold {
+		b.openedAt = time.Now()
+		b.probing = false
+	}
+}
@@ -0,0 +1,114 @@
+package upstream
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const cooldown = time.Minute
+
+	// 1ステップごとの操作
+	type step struct {
+		// Allow を呼んだときに期待する結果
+		allow error
+		// Allow で通ったときに記録する結果
+		ok bool
+		// Allow の前に Cooldown を経過させる
+		elapse bool
+		// ステップ後の IsOpen
+		open bool
+	}
+
+	cases := []struct {
+		name      string
+		threshold int
+		steps     []step
+	}{
+		{
+			name:      "閾値未満の失敗では開かない",
+			threshold: 3,
+			steps: []step{
+				{ok: false},
+				{ok: false},
+				{ok: true},
+				{ok: false},
+				{ok: false},
+			},
+		},
+		{
+			name:      "連続して閾値回失敗すると開く",
+			threshold: 2,
+			steps: []step{
+				{ok: false},
+				{ok: false, open: true},
+				{allow: ErrCircuitOpen, open: true},
+			},
+		},
+		{
+			name:      "Cooldown 後の試しが成功すれば閉じる",
+			threshold: 1,
+			steps: []step{
+				{ok: false, open: true},
+				{elapse: true, ok: true},
+				{ok: false, open: true},
+			},
+		},
+		{
+			name:      "Cooldown 後の試しが失敗すればまた開く",
+			threshold: 3,
+			steps: []step{
+				{ok: false},
+				{ok: false},
+				{ok: false, open: true},
+				// 試しは失敗1回で開き直す
+				{elapse: true, ok: false, open: true},
+				{allow: ErrCircuitOpen, open: true},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := NewCircuitBreaker(c.threshold, cooldown)
+			for i, s := range c.steps {
+				if s.elapse && !b.openedAt.IsZero() {
+					b.openedAt = b.openedAt.Add(-cooldown)
+				}
+				err := b.Allow()
+				if !errors.Is(err, s.allow) {
+					t.Fatalf("step %d: Allow() = %v, want %v", i, err, s.allow)
+				}
+				if err == nil {
+					b.Record(s.ok)
+				}
+				if got := b.IsOpen(); got != s.open {
+					t.Fatalf("step %d: IsOpen() = %v, want %v", i, got, s.open)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	b := NewCircuitBreaker(1, time.Minute)
+	b.Allow()
+	b.Record(false)
+	b.openedAt = b.openedAt.Add(-time.Minute)
+
+	// IsOpen は試しのリクエストを消費しない
+	if b.IsOpen() {
+		t.Fatal("IsOpen() = true after cooldown, want false")
+	}
+	if err := b.Allow(); err != nil {
+		t.Fatalf("first Allow() after cooldown = %v, want nil", err)
+	}
+	// 試しの結果が出るまでは他のリクエストを通さない
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("second Allow() while probing = %v, want ErrCircuitOpen", err)
+	}
+	if !b.IsOpen() {
+		t.Fatal("IsOpen() = false while probing, want true")
+	}
+}
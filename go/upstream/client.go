@@ -0,0 +1,148 @@
+// Package upstream は外部サービスへのHTTPリクエストに、タイムアウト・リトライ・サーキットブレーカーを付ける
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+type Policy struct {
+	// 1回のリクエストのタイムアウト
+	AttemptTimeout time.Duration
+	// 最初の1回を含めた試行回数
+	MaxAttempts int
+	// リトライ前に待つ時間の上限は BaseBackoff * 2^(n-1) と MaxBackoff の小さい方で、その範囲でランダムに待つ
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// リトライしてよいステータスコード。nil なら RetryableStatus を使う
+	Retryable func(statusCode int) bool
+}
+
+// RetryableStatus は一時的な障害を表すステータスコードかを返す
+func RetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Client は Policy に従ってリクエストを送る。Breaker が nil ならサーキットブレーカーを使わない
+type Client struct {
+	HTTPClient *http.Client
+	Policy     Policy
+	Breaker    *CircuitBreaker
+}
+
+// Do は newRequest で作ったリクエストを送り、リトライ可能な失敗であれば作り直して送り直す
+// リクエストボディは試行ごとに作り直す必要があるので、リクエストではなく作る関数を受け取る
+// 返すレスポンスのボディは読み込み済みなので、タイムアウト後も読める
+func (c *Client) Do(ctx context.Context, newRequest func(ctx context.Context) (*http.Request, error)) (*http.Response, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	retryable := c.Policy.Retryable
+	if retryable == nil {
+		retryable = RetryableStatus
+	}
+	maxAttempts := max(c.Policy.MaxAttempts, 1)
+
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if attempt > 1 {
+			if err := sleep(ctx, c.backoff(attempt-1)); err != nil {
+				return nil, errors.Join(lastErr, err)
+			}
+		}
+		if c.Breaker != nil {
+			if err := c.Breaker.Allow(); err != nil {
+				return nil, errors.Join(lastErr, err)
+			}
+		}
+
+		res, err := c.attempt(ctx, httpClient, newRequest)
+		if err == nil && !retryable(res.StatusCode) {
+			if c.Breaker != nil {
+				c.Breaker.Record(true)
+			}
+			return res, nil
+		}
+		if c.Breaker != nil {
+			c.Breaker.Record(false)
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("attempt %d: %w", attempt, err)
+		} else {
+			lastErr = fmt.Errorf("attempt %d: status code %d", attempt, res.StatusCode)
+			if attempt == maxAttempts {
+				return res, nil
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, lastErr
+		}
+	}
+	return nil, lastErr
+}
+
+func (c *Client) attempt(ctx context.Context, httpClient *http.Client, newRequest func(ctx context.Context) (*http.Request, error)) (*http.Response, error) {
+	if c.Policy.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Policy.AttemptTimeout)
+		defer cancel()
+	}
+	req, err := newRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	// タイムアウトでボディが読めなくなる前に読んでおく
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	return res, nil
+}
+
+// 試行回数 n 回目の失敗の後に待つ時間 (full jitter)
+func (c *Client) backoff(n int) time.Duration {
+	if c.Policy.BaseBackoff <= 0 {
+		return 0
+	}
+	d := c.Policy.BaseBackoff << min(n-1, 30)
+	if c.Policy.MaxBackoff > 0 && (d > c.Policy.MaxBackoff || d <= 0) {
+		d = c.Policy.MaxBackoff
+	}
+	return rand.N(d + 1)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
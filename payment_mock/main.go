@@ -4,23 +4,120 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"math/rand/v2"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 )
 
+type payment struct {
+	Token          string
+	IdempotencyKey string
+	Amount         int
+	RefundedAmount int
+}
+
+type refund struct {
+	PaymentKey string
+	Amount     int
+}
+
+const (
+	holdStateHeld     = "held"
+	holdStateCaptured = "captured"
+	holdStateVoided   = "voided"
+)
+
+// 与信。確定すると CaptureKey を冪等キーとする決済になる
+type hold struct {
+	Token      string
+	Amount     int
+	State      string
+	CaptureKey string
+}
+
 var (
-	data     = map[string][]int{}
-	dataLock sync.Mutex
+	// トークンごとの決済
+	data = map[string][]*payment{}
+	// 冪等キーごとの決済。同じトークン・決済額で再送されたら記録せずに成功を返す
+	paymentsByKey = map[string]*payment{}
+	// 冪等キーごとの返金
+	refundsByKey = map[string]refund{}
+	// 与信を取ったときの冪等キーごとの与信
+	holdsByKey = map[string]*hold{}
+	dataLock   sync.Mutex
+)
+
+// 決済ゲートウェイの異常を再現するための設定。/control/faults で変更する
+type Faults struct {
+	// レスポンスを返すまでの遅延
+	LatencyMs       int `json:"latency_ms"`
+	LatencyJitterMs int `json:"latency_jitter_ms"`
+	// 決済せずに500を返す割合 (0〜1)
+	ErrorRate float64 `json:"error_rate"`
+	// レスポンスを返さずに接続を切る割合 (0〜1)
+	DropRate float64 `json:"drop_rate"`
+	// 決済(返金)したのに500を返す割合 (0〜1)
+	ChargedButErrorRate float64 `json:"charged_but_error_rate"`
+}
+
+var (
+	faults     = Faults{}
+	faultsLock sync.Mutex
 )
 
 func main() {
 	mux := http.NewServeMux()
-	mux.HandleFunc("GET /payments", handleGetPayments)
-	mux.HandleFunc("POST /payments", handlePostPayments)
+	mux.HandleFunc("GET /payments", withFaults(handleGetPayments))
+	mux.HandleFunc("POST /payments", withFaults(handlePostPayments))
+	mux.HandleFunc("POST /payments/{payment_key}/refunds", withFaults(handlePostRefunds))
+	mux.HandleFunc("POST /holds", withFaults(handlePostHolds))
+	mux.HandleFunc("POST /holds/{hold_key}/capture", withFaults(handlePostHoldCapture))
+	mux.HandleFunc("POST /holds/{hold_key}/void", withFaults(handlePostHoldVoid))
+	mux.HandleFunc("GET /control/faults", handleGetFaults)
+	mux.HandleFunc("PUT /control/faults", handlePutFaults)
+	mux.HandleFunc("POST /control/reset", handlePostReset)
 	http.ListenAndServe(":12345", mux)
 }
 
+func currentFaults() Faults {
+	faultsLock.Lock()
+	defer faultsLock.Unlock()
+	return faults
+}
+
+// 遅延・500・切断を注入する。決済(返金)したのに500を返す場合は各ハンドラで扱う
+func withFaults(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f := currentFaults()
+		if latency := f.LatencyMs + rand.IntN(f.LatencyJitterMs+1); latency > 0 {
+			time.Sleep(time.Duration(latency) * time.Millisecond)
+		}
+		if rand.Float64() < f.DropRate {
+			dropConnection(w)
+			return
+		}
+		if rand.Float64() < f.ErrorRate {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "決済サーバーで障害が発生しています"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func dropConnection(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	conn.Close()
+}
+
 type PostPaymentsRequest struct {
 	Amount int `json:"amount"`
 }
@@ -31,6 +128,11 @@ func handlePostPayments(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
 		return
 	}
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "Idempotency-Key headerがセットされていません"})
+		return
+	}
 
 	var req PostPaymentsRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -38,51 +140,319 @@ func handlePostPayments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Amount <= 0 && req.Amount > 1_000_000 {
+	if req.Amount <= 0 || req.Amount > 1_000_000 {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "決済額が不正です"})
 		return
 	}
 
+	dataLock.Lock()
+	if p, ok := paymentsByKey[idempotencyKey]; ok {
+		dataLock.Unlock()
+		// 冪等キーはトークンをまたいで一意なので、別のトークンで再送されたら別の決済とみなして断る
+		if p.Token != token || p.Amount != req.Amount {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "同じIdempotency-Keyで異なる決済が指定されました"})
+			return
+		}
+		// 決済済みなので記録せずに成功を返す
+		slog.Info("決済済み", slog.String("token", token), slog.String("idempotency_key", idempotencyKey), slog.Int("amount", req.Amount))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 	// モックサーバーは任意のトークンを受け付けて、決済を記録する
+	p := &payment{Token: token, IdempotencyKey: idempotencyKey, Amount: req.Amount}
+	data[token] = append(data[token], p)
+	paymentsByKey[idempotencyKey] = p
+	dataLock.Unlock()
+
+	slog.Info("決済完了", slog.String("token", token), slog.String("idempotency_key", idempotencyKey), slog.Int("amount", req.Amount))
+	if rand.Float64() < currentFaults().ChargedButErrorRate {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "決済サーバーで障害が発生しています"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type PostRefundsRequest struct {
+	Amount int `json:"amount"`
+}
+
+// payment_key は返金する決済を送ったときの Idempotency-Key
+func handlePostRefunds(w http.ResponseWriter, r *http.Request) {
+	token, err := getTokenFromAuthorizationHeader(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "Idempotency-Key headerがセットされていません"})
+		return
+	}
+	paymentKey := r.PathValue("payment_key")
+
+	var req PostRefundsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "不正なリクエスト形式です"})
+		return
+	}
+	if req.Amount <= 0 || req.Amount > 1_000_000 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "返金額が不正です"})
+		return
+	}
+
 	dataLock.Lock()
-	arr, ok := data[token]
-	if !ok {
-		arr = []int{}
-		data[token] = arr
+	p, ok := paymentsByKey[paymentKey]
+	if !ok || p.Token != token {
+		dataLock.Unlock()
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "決済が見つかりません"})
+		return
 	}
-	arr = append(arr, req.Amount)
+	if rf, ok := refundsByKey[idempotencyKey]; ok {
+		dataLock.Unlock()
+		if rf.PaymentKey != paymentKey || rf.Amount != req.Amount {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "同じIdempotency-Keyで異なる返金が指定されました"})
+			return
+		}
+		// 返金済みなので記録せずに成功を返す
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if p.RefundedAmount+req.Amount > p.Amount {
+		dataLock.Unlock()
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "返金額が決済額を超えています"})
+		return
+	}
+	p.RefundedAmount += req.Amount
+	refundsByKey[idempotencyKey] = refund{PaymentKey: paymentKey, Amount: req.Amount}
 	dataLock.Unlock()
 
-	slog.Info("決済完了", slog.String("token", token), slog.Int("amount", req.Amount))
+	slog.Info("返金完了", slog.String("token", token), slog.String("payment_key", paymentKey), slog.Int("amount", req.Amount))
+	if rand.Float64() < currentFaults().ChargedButErrorRate {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "決済サーバーで障害が発生しています"})
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
-type ResponsePayment struct {
-	Amount int    `json:"amount"`
-	Status string `json:"status"`
+type PostHoldsRequest struct {
+	Amount int `json:"amount"`
 }
 
-func handleGetPayments(w http.ResponseWriter, r *http.Request) {
+// Idempotency-Key が与信のキーになる
+func handlePostHolds(w http.ResponseWriter, r *http.Request) {
+	token, err := getTokenFromAuthorizationHeader(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	holdKey := r.Header.Get("Idempotency-Key")
+	if holdKey == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "Idempotency-Key headerがセットされていません"})
+		return
+	}
+
+	var req PostHoldsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "不正なリクエスト形式です"})
+		return
+	}
+	if req.Amount <= 0 || req.Amount > 1_000_000 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "与信額が不正です"})
+		return
+	}
+
+	dataLock.Lock()
+	if h, ok := holdsByKey[holdKey]; ok {
+		dataLock.Unlock()
+		if h.Token != token || h.Amount != req.Amount {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "同じIdempotency-Keyで異なる与信が指定されました"})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	holdsByKey[holdKey] = &hold{Token: token, Amount: req.Amount, State: holdStateHeld}
+	dataLock.Unlock()
+
+	slog.Info("与信完了", slog.String("token", token), slog.String("hold_key", holdKey), slog.Int("amount", req.Amount))
+	if rand.Float64() < currentFaults().ChargedButErrorRate {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "決済サーバーで障害が発生しています"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type PostHoldCaptureRequest struct {
+	Amount int `json:"amount"`
+}
+
+// 与信額の範囲で決済を確定する。Idempotency-Key が確定した決済のキーになり、返金で使う
+func handlePostHoldCapture(w http.ResponseWriter, r *http.Request) {
 	token, err := getTokenFromAuthorizationHeader(r)
 	if err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
 		return
 	}
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "Idempotency-Key headerがセットされていません"})
+		return
+	}
+	holdKey := r.PathValue("hold_key")
+
+	var req PostHoldCaptureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "不正なリクエスト形式です"})
+		return
+	}
 
 	dataLock.Lock()
-	arr, _ := data[token]
+	h, ok := holdsByKey[holdKey]
+	if !ok || h.Token != token {
+		dataLock.Unlock()
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "与信が見つかりません"})
+		return
+	}
+	switch h.State {
+	case holdStateVoided:
+		dataLock.Unlock()
+		writeJSON(w, http.StatusConflict, map[string]string{"message": "与信は取り消されています"})
+		return
+	case holdStateCaptured:
+		dataLock.Unlock()
+		if p := paymentsByKey[h.CaptureKey]; h.CaptureKey != idempotencyKey || p.Amount != req.Amount {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "与信はすでに別の内容で確定されています"})
+			return
+		}
+		// 確定済みなので記録せずに成功を返す
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if req.Amount <= 0 || req.Amount > h.Amount {
+		dataLock.Unlock()
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "確定額が与信額を超えています"})
+		return
+	}
+	if _, ok := paymentsByKey[idempotencyKey]; ok {
+		dataLock.Unlock()
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "Idempotency-Keyが別の決済で使われています"})
+		return
+	}
+	p := &payment{Token: token, IdempotencyKey: idempotencyKey, Amount: req.Amount}
+	data[token] = append(data[token], p)
+	paymentsByKey[idempotencyKey] = p
+	h.State = holdStateCaptured
+	h.CaptureKey = idempotencyKey
 	dataLock.Unlock()
 
+	slog.Info("与信確定", slog.String("token", token), slog.String("hold_key", holdKey), slog.Int("amount", req.Amount))
+	if rand.Float64() < currentFaults().ChargedButErrorRate {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "決済サーバーで障害が発生しています"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handlePostHoldVoid(w http.ResponseWriter, r *http.Request) {
+	token, err := getTokenFromAuthorizationHeader(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	holdKey := r.PathValue("hold_key")
+
+	dataLock.Lock()
+	h, ok := holdsByKey[holdKey]
+	if !ok || h.Token != token {
+		dataLock.Unlock()
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "与信が見つかりません"})
+		return
+	}
+	if h.State == holdStateCaptured {
+		dataLock.Unlock()
+		writeJSON(w, http.StatusConflict, map[string]string{"message": "与信は確定されています"})
+		return
+	}
+	h.State = holdStateVoided
+	dataLock.Unlock()
+
+	slog.Info("与信取消", slog.String("token", token), slog.String("hold_key", holdKey))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ResponsePayment struct {
+	Amount         int    `json:"amount"`
+	RefundedAmount int    `json:"refunded_amount"`
+	Status         string `json:"status"`
+}
+
+func handleGetPayments(w http.ResponseWriter, r *http.Request) {
+	token, err := getTokenFromAuthorizationHeader(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+
+	dataLock.Lock()
+	arr := data[token]
 	res := make([]ResponsePayment, 0, len(arr))
-	for _, amount := range arr {
+	for _, p := range arr {
 		res = append(res, ResponsePayment{
-			Amount: amount,
-			Status: "成功",
+			Amount:         p.Amount,
+			RefundedAmount: p.RefundedAmount,
+			Status:         "成功",
 		})
 	}
+	dataLock.Unlock()
+
 	writeJSON(w, http.StatusOK, res)
 }
 
+func handleGetFaults(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentFaults())
+}
+
+func handlePutFaults(w http.ResponseWriter, r *http.Request) {
+	var f Faults
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "不正なリクエスト形式です"})
+		return
+	}
+	for _, rate := range []float64{f.ErrorRate, f.DropRate, f.ChargedButErrorRate} {
+		if rate < 0 || rate > 1 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": "割合は0から1の間で指定してください"})
+			return
+		}
+	}
+	if f.LatencyMs < 0 || f.LatencyJitterMs < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "遅延は0以上で指定してください"})
+		return
+	}
+
+	faultsLock.Lock()
+	faults = f
+	faultsLock.Unlock()
+
+	slog.Info("障害設定を変更", slog.Any("faults", f))
+	writeJSON(w, http.StatusOK, f)
+}
+
+// 決済・返金・与信の記録と障害設定を消す
+func handlePostReset(w http.ResponseWriter, r *http.Request) {
+	dataLock.Lock()
+	data = map[string][]*payment{}
+	paymentsByKey = map[string]*payment{}
+	refundsByKey = map[string]refund{}
+	holdsByKey = map[string]*hold{}
+	dataLock.Unlock()
+
+	faultsLock.Lock()
+	faults = Faults{}
+	faultsLock.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func getTokenFromAuthorizationHeader(r *http.Request) (string, error) {
 	auth := r.Header.Get("Authorization")
 	if !strings.HasPrefix(auth, "Bearer ") {
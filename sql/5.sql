@@ -24,6 +24,22 @@ UPDATE chairs SET
     longitude = (SELECT longitude FROM chair_locations WHERE chair_locations.chair_id = chairs.id ORDER BY created_at DESC LIMIT 1),
     moved_at = (SELECT created_at FROM chair_locations WHERE chair_locations.chair_id = chairs.id ORDER BY created_at DESC LIMIT 1);
 
+-- 1ユーザーが複数の決済トークンを持てるようにする。既存のトークンはデフォルトにする
+ALTER TABLE payment_tokens
+  DROP PRIMARY KEY,
+  ADD COLUMN id BIGINT NOT NULL AUTO_INCREMENT FIRST,
+  ADD PRIMARY KEY (id),
+  ADD COLUMN is_default TINYINT(1) NOT NULL DEFAULT 0 COMMENT '評価時に最初に使うトークンか',
+  ADD UNIQUE payment_tokens_user_id_token (user_id, token);
+UPDATE payment_tokens SET is_default = 1;
+
+ALTER TABLE rides
+  ADD COLUMN canceled_at DATETIME(6) NULL DEFAULT NULL COMMENT 'キャンセル日時',
+  ADD COLUMN payment_idempotency_key VARCHAR(26) NOT NULL DEFAULT '' COMMENT '決済ゲートウェイに送る冪等キー',
+  ADD COLUMN fare_rule_version INTEGER NOT NULL DEFAULT 1 COMMENT '見積もったときの運賃ルールのバージョン',
+  ADD COLUMN surge_percent INTEGER NOT NULL DEFAULT 100 COMMENT '見積もったときのサージの倍率 (%)';
+UPDATE rides SET payment_idempotency_key = id;
+
 ALTER TABLE ride_statuses DROP COLUMN id;
 ALTER TABLE ride_statuses DROP COLUMN chair_sent_at;
 ALTER TABLE ride_statuses DROP COLUMN app_sent_at;
@@ -32,11 +48,23 @@ DROP TABLE IF EXISTS ride_status;
 CREATE TABLE ride_status
 (
   ride_id VARCHAR(26)                                                                        NOT NULL COMMENT 'ライドID',
-  status          ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED') NOT NULL COMMENT '状態',
+  status          ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED', 'CANCELED') NOT NULL COMMENT '状態',
   updated_at      DATETIME(6)                                                                NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '状態変更日時',
-  PRIMARY KEY (ride_id, status, updated_at)
+  PRIMARY KEY (ride_id)
+)
+  COMMENT = 'ライドの現在のステータステーブル';
+
+DROP TABLE IF EXISTS ride_status_events;
+CREATE TABLE ride_status_events
+(
+  id         BIGINT                                                                     NOT NULL AUTO_INCREMENT,
+  ride_id    VARCHAR(26)                                                                NOT NULL COMMENT 'ライドID',
+  status     ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED', 'CANCELED') NOT NULL COMMENT '状態',
+  created_at DATETIME(6)                                                                NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '状態変更日時',
+  PRIMARY KEY (id)
 )
-  COMMENT = 'ライドステータスの変更履歴テーブル';
+  COMMENT = 'ライドステータスの変更履歴テーブル(追記のみ)';
+CREATE INDEX ride_status_events_ride_id_index ON ride_status_events (ride_id, id);
 
 INSERT INTO ride_status
 SELECT 
@@ -58,4 +86,213 @@ ON
     t1.ride_id = t2.ride_id 
     AND t1.created_at = t2.latest_created_at;
 
+INSERT INTO ride_status_events (ride_id, status, created_at)
+SELECT ride_id, status, created_at FROM ride_statuses ORDER BY created_at;
+
 DROP TABLE ride_statuses;
+
+DROP TABLE IF EXISTS notifications;
+CREATE TABLE notifications
+(
+  id          BIGINT                                                                                 NOT NULL AUTO_INCREMENT COMMENT 'SSEのイベントID',
+  target_type ENUM ('user', 'chair')                                                                 NOT NULL COMMENT '通知先の種類',
+  target_id   VARCHAR(26)                                                                            NOT NULL COMMENT '通知先のユーザーIDまたは椅子ID',
+  ride_id     VARCHAR(26)                                                                            NOT NULL COMMENT 'ライドID',
+  status      ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED', 'CANCELED') NOT NULL COMMENT '通知する状態',
+  created_at  DATETIME(6)                                                                            NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '通知日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = 'ユーザー・椅子への通知テーブル';
+CREATE INDEX notifications_target_index ON notifications (target_type, target_id, id);
+CREATE INDEX notifications_created_at_index ON notifications (created_at);
+
+DROP TABLE IF EXISTS notification_prunes;
+CREATE TABLE notification_prunes
+(
+  target_type ENUM ('user', 'chair') NOT NULL COMMENT '通知先の種類',
+  target_id   VARCHAR(26)            NOT NULL COMMENT '通知先のユーザーIDまたは椅子ID',
+  pruned_id   BIGINT                 NOT NULL COMMENT 'このIDまでの通知は消した',
+  PRIMARY KEY (target_type, target_id)
+)
+  COMMENT = '通知先ごとに消した通知の位置';
+
+DROP TABLE IF EXISTS payments;
+CREATE TABLE payments
+(
+  id              VARCHAR(26)                                                                        NOT NULL COMMENT '決済ID',
+  ride_id         VARCHAR(26)                                                                        NOT NULL COMMENT 'ライドID',
+  user_id         VARCHAR(26)                                                                        NOT NULL COMMENT 'ユーザーID',
+  token           VARCHAR(255)                                                                       NOT NULL COMMENT '決済トークン',
+  amount          INTEGER                                                                            NOT NULL COMMENT '決済額 (HELD の間は与信額)',
+  idempotency_key VARCHAR(26)                                                                        NOT NULL COMMENT '決済ゲートウェイに送る冪等キー',
+  kind            ENUM ('CHARGE', 'CAPTURE', 'VOID')                                                 NOT NULL DEFAULT 'CHARGE' COMMENT '決済・与信の確定・与信の取り消しのどれを送るか',
+  hold_key        VARCHAR(26)                                                                        NULL COMMENT '与信を取ったときの冪等キー',
+  status          ENUM ('PLACING', 'HELD', 'PENDING', 'SUCCEEDED', 'FAILED', 'UNKNOWN', 'ABANDONED') NOT NULL DEFAULT 'PENDING' COMMENT '決済の状態',
+  attempts        INTEGER                                                                            NOT NULL DEFAULT 0 COMMENT '送信回数',
+  last_error      TEXT                                                                               NULL COMMENT '最後の送信で起きたエラー',
+  next_attempt_at DATETIME(6)                                                                        NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '次に送信してよい日時',
+  created_at      DATETIME(6)                                                                        NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  updated_at      DATETIME(6)                                                                        NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (id),
+  UNIQUE (ride_id),
+  UNIQUE (idempotency_key)
+)
+  COMMENT = '決済のアウトボックステーブル';
+CREATE INDEX payments_status_index ON payments (status, next_attempt_at);
+CREATE INDEX payments_token_index ON payments (token, status);
+
+DROP TABLE IF EXISTS refunds;
+CREATE TABLE refunds
+(
+  id              VARCHAR(26)                             NOT NULL COMMENT '返金ID',
+  ride_id         VARCHAR(26)                             NOT NULL COMMENT 'ライドID',
+  payment_id      VARCHAR(26)                             NOT NULL COMMENT '返金する決済のID',
+  amount          INTEGER                                 NOT NULL COMMENT '返金額',
+  reason          TEXT                                    NOT NULL COMMENT '返金理由',
+  idempotency_key VARCHAR(26)                             NOT NULL COMMENT '決済ゲートウェイに送る冪等キー',
+  status          ENUM ('PENDING', 'SUCCEEDED', 'FAILED') NOT NULL DEFAULT 'PENDING' COMMENT '返金の状態',
+  last_error      TEXT                                    NULL COMMENT '最後の送信で起きたエラー',
+  created_at      DATETIME(6)                             NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  updated_at      DATETIME(6)                             NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (id),
+  UNIQUE (idempotency_key)
+)
+  COMMENT = '返金テーブル';
+CREATE INDEX refunds_payment_id_index ON refunds (payment_id, status);
+CREATE INDEX refunds_ride_id_index ON refunds (ride_id);
+
+-- 運賃ルール。変えるときは effective_from を指定して新しいバージョンを追加する
+DROP TABLE IF EXISTS fare_rules;
+CREATE TABLE fare_rules
+(
+  version           INTEGER     NOT NULL AUTO_INCREMENT COMMENT 'バージョン',
+  effective_from    DATETIME(6) NOT NULL COMMENT 'この日時以降に見積もるライドに適用する',
+  initial_fare      INTEGER     NOT NULL COMMENT '初乗り運賃',
+  fare_per_distance INTEGER     NOT NULL COMMENT '最初の段階の距離あたりの運賃',
+  minimum_fare      INTEGER     NOT NULL DEFAULT 0 COMMENT '最低運賃 (割引前)',
+  created_at        DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (version)
+)
+  COMMENT = '運賃ルールテーブル';
+CREATE INDEX fare_rules_effective_from_index ON fare_rules (effective_from);
+
+DROP TABLE IF EXISTS fare_rule_distance_tiers;
+CREATE TABLE fare_rule_distance_tiers
+(
+  version           INTEGER NOT NULL COMMENT '運賃ルールのバージョン',
+  from_distance     INTEGER NOT NULL COMMENT 'この距離を超えた分から適用する',
+  fare_per_distance INTEGER NOT NULL COMMENT '距離あたりの運賃',
+  PRIMARY KEY (version, from_distance)
+)
+  COMMENT = '運賃ルールの距離の段階テーブル';
+
+DROP TABLE IF EXISTS fare_rule_model_multipliers;
+CREATE TABLE fare_rule_model_multipliers
+(
+  version            INTEGER     NOT NULL COMMENT '運賃ルールのバージョン',
+  model              VARCHAR(50) NOT NULL COMMENT '椅子モデル名 (chair_models.name)',
+  multiplier_percent INTEGER     NOT NULL COMMENT '運賃の倍率 (%)',
+  PRIMARY KEY (version, model)
+)
+  COMMENT = '運賃ルールの椅子モデルごとの倍率テーブル';
+
+-- これまでの運賃をバージョン1とする
+INSERT INTO fare_rules (version, effective_from, initial_fare, fare_per_distance) VALUES (1, '2000-01-01 00:00:00', 500, 100);
+
+-- マッチングのたびに更新するサージの倍率。倍率が1のセルは行を持たない
+DROP TABLE IF EXISTS surge_cells;
+CREATE TABLE surge_cells
+(
+  cell_latitude  INTEGER     NOT NULL COMMENT 'セルの緯度方向の番号',
+  cell_longitude INTEGER     NOT NULL COMMENT 'セルの経度方向の番号',
+  multiplier     DOUBLE      NOT NULL COMMENT 'ならした倍率',
+  updated_at     DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (cell_latitude, cell_longitude)
+)
+  COMMENT = 'サージ料金テーブル';
+
+-- クーポンのキャンペーン。付与するクーポンのコード、割引、期限、上限、使える条件を決める
+DROP TABLE IF EXISTS campaigns;
+CREATE TABLE campaigns
+(
+  id              VARCHAR(64)                 NOT NULL COMMENT 'キャンペーンID',
+  code_pattern    VARCHAR(255)                NOT NULL COMMENT 'クーポンコードの形式 ({invitation_code}, {timestamp} を置き換える)',
+  discount_type   ENUM ('FIXED', 'PERCENT')   NOT NULL COMMENT '定額割引か定率割引か',
+  discount_value  INTEGER                     NOT NULL COMMENT '割引額、または割引率 (%)',
+  max_discount    INTEGER                     NULL COMMENT '定率割引の上限額',
+  starts_at       DATETIME(6)                 NULL COMMENT 'この日時から付与・利用できる',
+  expires_at      DATETIME(6)                 NULL COMMENT 'この日時を過ぎたら付与・利用できない',
+  per_user_limit  INTEGER                     NULL COMMENT '1ユーザーに付与できる枚数',
+  global_limit    INTEGER                     NULL COMMENT '全体で付与できる枚数',
+  first_ride_only TINYINT(1)                  NOT NULL DEFAULT 0 COMMENT '初回のライドにだけ使える',
+  min_fare        INTEGER                     NOT NULL DEFAULT 0 COMMENT '割引前の運賃がこれ以上のときだけ使える',
+  priority        INTEGER                     NOT NULL DEFAULT 0 COMMENT '大きいほど先に使う',
+  created_at      DATETIME(6)                 NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = 'クーポンのキャンペーンテーブル';
+
+INSERT INTO campaigns (id, code_pattern, discount_type, discount_value, priority)
+VALUES ('signup', 'CP_NEW2024', 'FIXED', 3000, 1),
+       ('invitee', 'INV_{invitation_code}', 'FIXED', 1500, 0),
+       ('inviter', 'RWD_{invitation_code}_{timestamp}', 'FIXED', 1000, 0);
+
+ALTER TABLE coupons
+  ADD COLUMN campaign_id VARCHAR(64) NULL COMMENT '付与したキャンペーンのID';
+UPDATE coupons
+  JOIN campaigns ON coupons.code LIKE REPLACE(REPLACE(campaigns.code_pattern, '{invitation_code}', '%'), '{timestamp}', '%')
+  SET coupons.campaign_id = campaigns.id;
+CREATE INDEX coupons_campaign_id_index ON coupons (campaign_id, user_id);
+
+-- 招待の台帳。招待コードを使える回数はこのテーブルで数える
+-- coupons と違ってプライマリーにあるので、招待した人の users の行をロックして数えれば上限を超えない
+DROP TABLE IF EXISTS invitations;
+CREATE TABLE invitations
+(
+  id                 BIGINT       NOT NULL AUTO_INCREMENT,
+  inviter_id         VARCHAR(26)  NOT NULL COMMENT '招待したユーザーのID',
+  invitee_id         VARCHAR(26)  NOT NULL COMMENT '招待コードを使って登録したユーザーのID',
+  invitation_code    VARCHAR(30)  NOT NULL COMMENT '使われた招待コード',
+  reward_coupon_code VARCHAR(255) NULL COMMENT '招待した人に付与したクーポンのコード',
+  created_at         DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (id),
+  UNIQUE KEY invitations_invitee_id_unique (invitee_id),
+  KEY invitations_inviter_id_index (inviter_id, created_at)
+)
+  COMMENT = '招待テーブル';
+
+-- これまでの招待クーポンから台帳を作る。招待した人の Reward は付与された順に対応させる
+INSERT INTO invitations (inviter_id, invitee_id, invitation_code, reward_coupon_code, created_at)
+SELECT inviters.id, inv.user_id, inviters.invitation_code, rwd.code, inv.created_at
+FROM (SELECT user_id,
+             SUBSTRING(code, 5) AS invitation_code,
+             created_at,
+             ROW_NUMBER() OVER (PARTITION BY code ORDER BY created_at, user_id) AS n
+      FROM coupons
+      WHERE campaign_id = 'invitee') inv
+       JOIN users inviters ON inviters.invitation_code = inv.invitation_code
+       LEFT JOIN (SELECT user_id,
+                         code,
+                         ROW_NUMBER() OVER (PARTITION BY user_id ORDER BY created_at, code) AS n
+                  FROM coupons
+                  WHERE campaign_id = 'inviter') rwd ON rwd.user_id = inviters.id AND rwd.n = inv.n;
+
+-- 利用履歴をライドIDのカーソルでページ送りする
+CREATE INDEX rides_user_id_id_index ON rides (user_id, id);
+
+-- 売上は完了したときに記録し、返金されたら差し引いて記録し直す。オーナーの売上はこの列を集計する
+ALTER TABLE rides
+  ADD COLUMN sale INTEGER NULL COMMENT '返金分を差し引いた売上';
+-- これまでのライドはすべてバージョン1のルール (初乗り500、距離あたり100) でサージなし
+UPDATE rides
+  SET sale = 500 + 100 * (ABS(pickup_latitude - destination_latitude) + ABS(pickup_longitude - destination_longitude))
+  WHERE evaluation IS NOT NULL;
+
+-- 見積もりIDで配車したライドは、椅子のモデルによらず見積もった運賃を請求する
+ALTER TABLE rides
+  ADD COLUMN quoted_fare INTEGER NULL COMMENT '見積もりIDで確定した割引後の運賃';
+
+-- 見積もりIDは1回の配車にしか使えない
+ALTER TABLE rides
+  ADD COLUMN quote_id VARCHAR(26) NULL COMMENT '配車に使った見積もりID';
+CREATE UNIQUE INDEX rides_quote_id_index ON rides (quote_id);